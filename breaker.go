@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/devfans/golang/log"
+)
+
+// ErrCircuitOpen is returned without calling the backend while the circuit breaker is open.
+var ErrCircuitOpen = errors.New("Cloud service temporarily unavailable, please retry later.")
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// callOutcome is what a call tells the circuit breaker about the backend's health.
+type callOutcome int
+
+const (
+	callSucceeded callOutcome = iota
+	callFailed
+	// callIgnored says nothing about the backend, e.g. the caller cancelled.
+	callIgnored
+)
+
+// circuitBreaker fails upstream calls fast while the backend is down.
+//
+// It opens after threshold consecutive failed calls and rejects calls with ErrCircuitOpen
+// for coolDown. Then it half-opens, letting a single probe call through: the breaker closes
+// if the probe succeeds and opens again for another coolDown if it fails. A threshold of
+// zero disables the breaker.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	coolDown  time.Duration
+	state     circuitState
+	failures  int
+	openedAt  time.Time
+	probing   bool
+	now       func() time.Time
+}
+
+func newCircuitBreaker(threshold int, coolDown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, coolDown: coolDown, now: time.Now}
+}
+
+// upstreamBreaker guards the service calls to the backend.
+var upstreamBreaker = newCircuitBreaker(int(CIRCUIT_BREAKER_THRESHOLD), CIRCUIT_BREAKER_COOLDOWN)
+
+// Allow returns ErrCircuitOpen if a call must not be made now. A caller allowed through
+// must report how the call went with Record.
+func (b *circuitBreaker) Allow() error {
+	if b.threshold <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if b.now().Sub(b.openedAt) < b.coolDown {
+			return ErrCircuitOpen
+		}
+		b.setState(circuitHalfOpen)
+		b.probing = true
+		return nil
+	case circuitHalfOpen:
+		if b.probing {
+			return ErrCircuitOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// Record reports the outcome of a call allowed by Allow.
+func (b *circuitBreaker) Record(outcome callOutcome) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitClosed:
+		switch outcome {
+		case callSucceeded:
+			b.failures = 0
+		case callFailed:
+			if b.failures++; b.failures >= b.threshold {
+				b.open()
+			}
+		}
+	case circuitHalfOpen:
+		b.probing = false
+		switch outcome {
+		case callSucceeded:
+			b.failures = 0
+			b.setState(circuitClosed)
+		case callFailed:
+			b.open()
+		}
+	}
+	// Calls let through before the breaker opened are ignored once it is open.
+}
+
+// State returns the current state of the breaker.
+func (b *circuitBreaker) State() circuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *circuitBreaker) open() {
+	b.openedAt = b.now()
+	b.setState(circuitOpen)
+}
+
+func (b *circuitBreaker) setState(state circuitState) {
+	if b.state != state {
+		log.Warn("Upstream circuit breaker state changed", "from", b.state, "to", state, "failures", b.failures)
+		b.state = state
+	}
+}
+
+// upstreamOutcome classifies the result of an upstream call for the circuit breaker: only
+// connection errors, 5xx, throttled and busy responses count as failures, as other business
+// errors and 4xx responses show the backend is up.
+func upstreamOutcome(err error) callOutcome {
+	var apiErr *APIError
+	var statusErr *StatusError
+	switch {
+	case err == nil:
+		return callSucceeded
+	case errors.Is(err, context.Canceled), errors.Is(err, ErrMissingSecret):
+		return callIgnored
+	case errors.As(err, &apiErr):
+		if apiErr.RateLimited() || apiErr.Code == CodeServerBusy {
+			return callFailed
+		}
+		return callSucceeded
+	case errors.As(err, &statusErr):
+		if statusErr.StatusCode >= 500 || statusErr.StatusCode == 429 {
+			return callFailed
+		}
+		return callSucceeded
+	}
+	return callFailed
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	b := newCircuitBreaker(2, time.Minute)
+	b.now = func() time.Time { return now }
+
+	expect := func(state circuitState, allowed bool) {
+		t.Helper()
+		if got := b.State(); got != state {
+			t.Fatalf("got state %s, want %s", got, state)
+		}
+		if err := b.Allow(); (err == nil) != allowed {
+			t.Fatalf("got Allow() = %v in state %s, want allowed %v", err, b.State(), allowed)
+		}
+	}
+
+	// Closed: a success resets the count of consecutive failures.
+	expect(circuitClosed, true)
+	b.Record(callFailed)
+	expect(circuitClosed, true)
+	b.Record(callSucceeded)
+	expect(circuitClosed, true)
+	b.Record(callFailed)
+	expect(circuitClosed, true)
+	b.Record(callIgnored)
+	expect(circuitClosed, true)
+	b.Record(callFailed)
+
+	// Open: calls fail fast until the cool-down passes.
+	expect(circuitOpen, false)
+	now = now.Add(time.Minute - time.Second)
+	expect(circuitOpen, false)
+
+	// Half-open: a single probe goes through, a failed one opens the breaker again.
+	now = now.Add(time.Second)
+	expect(circuitOpen, true)
+	expect(circuitHalfOpen, false)
+	b.Record(callFailed)
+	expect(circuitOpen, false)
+
+	// A successful probe closes the breaker.
+	now = now.Add(time.Minute)
+	expect(circuitOpen, true)
+	b.Record(callSucceeded)
+	expect(circuitClosed, true)
+	b.Record(callFailed)
+	expect(circuitClosed, true)
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	b := newCircuitBreaker(0, time.Minute)
+	for range 10 {
+		if err := b.Allow(); err != nil {
+			t.Fatalf("disabled breaker refused a call: %v", err)
+		}
+		b.Record(callFailed)
+	}
+	if got := b.State(); got != circuitClosed {
+		t.Errorf("got state %s, want closed", got)
+	}
+}
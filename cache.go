@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/devfans/golang/log"
+)
+
+// cachedServices are the query services whose results rarely change and are cached for QUERY_CACHE_TTL.
+var cachedServices = []string{"DeviceQuery", "GetScenes"}
+
+// queryCache caches the results of cachedServices keyed by account, service name and request payload.
+var queryCache = newTTLCache(QUERY_CACHE_TTL)
+
+type cacheEntry struct {
+	value     any
+	expiresAt time.Time
+}
+
+// ttlCache is a concurrency safe in-memory cache whose entries expire after ttl.
+// A zero ttl disables caching.
+type ttlCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]cacheEntry
+}
+
+func newTTLCache(ttl time.Duration) *ttlCache {
+	return &ttlCache{ttl: ttl, entries: make(map[string]cacheEntry)}
+}
+
+// Get returns the cached value of key if it has not expired yet.
+func (c *ttlCache) Get(key string) (any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.value, true
+}
+
+// Set caches value under key for the cache's ttl.
+func (c *ttlCache) Set(key string, value any) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	// Drop expired entries as we go, the key space is small.
+	for k, entry := range c.entries {
+		if now.After(entry.expiresAt) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cacheEntry{value: value, expiresAt: now.Add(c.ttl)}
+}
+
+// Purge drops all cached entries.
+func (c *ttlCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.entries)
+}
+
+// PurgeQueryCache drops the cached device and scene queries, so the next query hits the backend.
+func PurgeQueryCache() {
+	queryCache.Purge()
+	log.Info("Query cache purged")
+}
+
+// queryCacheKey returns the cache key of a service call made with token, or false if the service
+// is not cached. Sessions logged in to different accounts never share cached results.
+func queryCacheKey(token, serviceName string, data any) (string, bool) {
+	if !slices.Contains(cachedServices, serviceName) {
+		return "", false
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return "", false
+	}
+	return md5Hash(token) + ":" + serviceName + ":" + string(payload), true
+}
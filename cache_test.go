@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTLCache(t *testing.T) {
+	c := newTTLCache(20 * time.Millisecond)
+	if _, ok := c.Get("devices"); ok {
+		t.Fatal("hit on an empty cache")
+	}
+	c.Set("devices", "value")
+	if value, ok := c.Get("devices"); !ok || value != "value" {
+		t.Fatalf("got %v %v, want a hit", value, ok)
+	}
+	if _, ok := c.Get("scenes"); ok {
+		t.Error("hit on another key")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := c.Get("devices"); ok {
+		t.Error("hit on an expired entry")
+	}
+
+	c.Set("devices", "value")
+	c.Purge()
+	if _, ok := c.Get("devices"); ok {
+		t.Error("hit after purge")
+	}
+}
+
+func TestTTLCacheDisabled(t *testing.T) {
+	c := newTTLCache(0)
+	c.Set("devices", "value")
+	if _, ok := c.Get("devices"); ok {
+		t.Error("hit with caching disabled")
+	}
+}
+
+func TestQueryCacheKey(t *testing.T) {
+	data := map[string]any{"positions": []string{"客厅"}}
+	key, ok := queryCacheKey("token", "DeviceQuery", data)
+	if !ok {
+		t.Fatal("DeviceQuery is not cached")
+	}
+	if other, _ := queryCacheKey("another", "DeviceQuery", data); other == key {
+		t.Error("accounts share a cache key")
+	}
+	if other, _ := queryCacheKey("token", "DeviceQuery", map[string]any{"positions": []string{"卧室"}}); other == key {
+		t.Error("payloads share a cache key")
+	}
+	if _, ok := queryCacheKey("token", "DeviceControl", data); ok {
+		t.Error("DeviceControl is cached")
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// deviceID is a device id in tool arguments. Clients format numbers inconsistently, so
+// 123, 123.0 and "123" are all accepted as the same id.
+type deviceID int
+
+func (id *deviceID) UnmarshalJSON(data []byte) error {
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	n, err := parseDeviceID(value)
+	if err != nil {
+		return err
+	}
+	*id = deviceID(n)
+	return nil
+}
+
+// parseDeviceID coerces a JSON number or numeric string holding a whole number into a device id.
+func parseDeviceID(value any) (int, error) {
+	var f float64
+	switch v := value.(type) {
+	case float64:
+		f = v
+	case string:
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid device id %q: not a number", v)
+		}
+		f = parsed
+	default:
+		return 0, fmt.Errorf("invalid device id %v: not a number", value)
+	}
+	if f != math.Trunc(f) || f < math.MinInt32 || f > math.MaxInt32 {
+		return 0, fmt.Errorf("invalid device id %v: not a whole number", value)
+	}
+	return int(f), nil
+}
+
+// deviceIDs converts device ids from tool arguments for the API wrappers.
+func deviceIDs(ids []deviceID) []int {
+	result := make([]int, len(ids))
+	for i, id := range ids {
+		result[i] = int(id)
+	}
+	return result
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDeviceIDCoercion(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		want  int
+		valid bool
+	}{
+		{`123`, 123, true},
+		{`123.0`, 123, true},
+		{`"123"`, 123, true},
+		{`" 42 "`, 42, true},
+		{`"1e3"`, 1000, true},
+		{`-5`, -5, true},
+		{`12.5`, 0, false},
+		{`"12.5"`, 0, false},
+		{`"lamp"`, 0, false},
+		{`""`, 0, false},
+		{`true`, 0, false},
+		{`null`, 0, false},
+		{`[1]`, 0, false},
+		{`4294967296`, 0, false},
+	} {
+		var id deviceID
+		err := json.Unmarshal([]byte(tc.input), &id)
+		if (err == nil) != tc.valid {
+			t.Errorf("unmarshal %s: got %v, want valid %v", tc.input, err, tc.valid)
+			continue
+		}
+		if tc.valid && int(id) != tc.want {
+			t.Errorf("unmarshal %s: got %d, want %d", tc.input, id, tc.want)
+		}
+	}
+
+	var args argToggleDevice
+	if err := json.Unmarshal([]byte(`{"devices":[1,"2",3.0]}`), &args); err != nil {
+		t.Fatal(err)
+	}
+	if ids := deviceIDs(args.Devices); len(ids) != 3 || ids[0] != 1 || ids[1] != 2 || ids[2] != 3 {
+		t.Errorf("got devices %v, want [1 2 3]", ids)
+	}
+}
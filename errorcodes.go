@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// Stable error codes reported to clients in the _meta of failed tool results, so they can
+// branch on the failure instead of matching the message text.
+const (
+	ErrorAuthExpired         = "AUTH_EXPIRED"
+	ErrorAuthFailed          = "AUTH_FAILED"
+	ErrorInvalidSignature    = "INVALID_SIGNATURE"
+	ErrorRateLimited         = "RATE_LIMITED"
+	ErrorUpstreamUnavailable = "UPSTREAM_UNAVAILABLE"
+	ErrorUpstreamError       = "UPSTREAM_ERROR"
+	ErrorNotInitialized      = "NOT_INITIALIZED"
+	ErrorCancelled           = "CANCELLED"
+	ErrorReadOnly            = "READ_ONLY"
+	ErrorInternal            = "INTERNAL"
+)
+
+// apiErrorCodes maps the business codes of the backend to error codes, add an entry to
+// report a new code. Unlisted codes are reported as ErrorUpstreamError.
+var apiErrorCodes = map[int]string{
+	CodeInvalidSignature: ErrorInvalidSignature,
+	CodeServerBusy:       ErrorUpstreamUnavailable,
+	CodeTokenInvalid:     ErrorAuthExpired,
+	CodeTokenExpired:     ErrorAuthExpired,
+	CodeRateLimited:      ErrorRateLimited,
+}
+
+// Keys of the error code and the backend's business code in the _meta of tool results.
+const (
+	errorCodeMetaKey    = "yalla/error_code"
+	upstreamCodeMetaKey = "yalla/upstream_code"
+)
+
+// errorCode returns the error code of an upstream call error.
+func errorCode(err error) string {
+	var apiErr *APIError
+	var statusErr *StatusError
+	switch {
+	case errors.As(err, &apiErr):
+		if code, ok := apiErrorCodes[apiErr.Code]; ok {
+			return code
+		}
+		return ErrorUpstreamError
+	case errors.As(err, &statusErr):
+		switch {
+		case statusErr.StatusCode == http.StatusTooManyRequests:
+			return ErrorRateLimited
+		case statusErr.StatusCode == http.StatusUnauthorized || statusErr.StatusCode == http.StatusForbidden:
+			return ErrorAuthFailed
+		case statusErr.StatusCode >= http.StatusInternalServerError:
+			return ErrorUpstreamUnavailable
+		}
+		return ErrorUpstreamError
+	case errors.Is(err, ErrCircuitOpen):
+		return ErrorUpstreamUnavailable
+	case errors.Is(err, ErrMissingSecret):
+		return ErrorNotInitialized
+	case errors.Is(err, ErrReadOnly):
+		return ErrorReadOnly
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return ErrorCancelled
+	}
+	return ErrorInternal
+}
+
+// callFailure holds the errors of the upstream calls made by a tool call.
+type callFailure struct {
+	mu   sync.Mutex
+	errs []error
+}
+
+type callFailureKey struct{}
+
+// recordCallError records the error of an upstream call for the tool call of ctx, a nil
+// err is ignored.
+func recordCallError(ctx context.Context, err error) {
+	if f, ok := ctx.Value(callFailureKey{}).(*callFailure); ok && err != nil {
+		f.mu.Lock()
+		f.errs = append(f.errs, err)
+		f.mu.Unlock()
+	}
+}
+
+// cause returns the recorded error that produced the failed result, the latest one whose
+// message is part of the result text, or the only error recorded. It returns nil if the
+// cause cannot be told.
+func (f *callFailure) cause(result *mcp.CallToolResult) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var text strings.Builder
+	for _, content := range result.Content {
+		if c, ok := content.(*mcp.TextContent); ok {
+			text.WriteString(c.Text)
+		}
+	}
+	for i := len(f.errs) - 1; i >= 0; i-- {
+		if message := f.errs[i].Error(); message != "" && strings.Contains(text.String(), message) {
+			return f.errs[i]
+		}
+	}
+	if len(f.errs) == 1 {
+		return f.errs[0]
+	}
+	return nil
+}
+
+// errorCodeMiddleware adds the error code to the _meta of failed tool results caused by an
+// upstream call, along with the backend's business code if it returned one. Handlers report
+// upstream failures as text, so the code is taken from the call instead of the result.
+func errorCodeMiddleware(next mcp.MethodHandler) mcp.MethodHandler {
+	return func(ctx context.Context, method string, req mcp.Request) (mcp.Result, error) {
+		if _, ok := req.(*mcp.CallToolRequest); !ok {
+			return next(ctx, method, req)
+		}
+		failure := &callFailure{}
+		result, err := next(context.WithValue(ctx, callFailureKey{}, failure), method, req)
+		ctr, ok := result.(*mcp.CallToolResult)
+		if err != nil || !ok || ctr == nil || !ctr.IsError {
+			return result, err
+		}
+		callErr := failure.cause(ctr)
+		if callErr == nil {
+			return result, nil
+		}
+		if ctr.Meta == nil {
+			ctr.Meta = mcp.Meta{}
+		}
+		ctr.Meta[errorCodeMetaKey] = errorCode(callErr)
+		var apiErr *APIError
+		if errors.As(callErr, &apiErr) {
+			ctr.Meta[upstreamCodeMetaKey] = apiErr.Code
+		}
+		return result, nil
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+func TestErrorCodeMiddleware(t *testing.T) {
+	expired := &APIError{Code: CodeTokenExpired, Message: "token expired"}
+	limited := &APIError{Code: CodeRateLimited, Message: "too many requests"}
+	for _, tc := range []struct {
+		name   string
+		errs   []error
+		result *mcp.CallToolResult
+		want   string
+	}{
+		{"success", nil, simpleResult("ok"), ""},
+		{"failure without upstream error", nil, errorResult("Device list cannot be empty"), ""},
+		{"recovered upstream error", []error{limited}, simpleResult("ok"), ""},
+		{"single error", []error{limited}, errorResult("Query failed"), ErrorRateLimited},
+		{"error in result", []error{expired, limited}, errorResult("Query failed: token expired"), ErrorAuthExpired},
+		{"later error in result", []error{expired, limited}, errorResult("Query failed: too many requests"), ErrorRateLimited},
+		{"cause unknown", []error{expired, limited}, errorResult("Query failed"), ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := errorCodeMiddleware(func(ctx context.Context, method string, req mcp.Request) (mcp.Result, error) {
+				for _, err := range tc.errs {
+					recordCallError(ctx, err)
+				}
+				recordCallError(ctx, nil)
+				return tc.result, nil
+			})
+			result, err := handler(context.Background(), "tools/call", toolRequest())
+			if err != nil {
+				t.Fatal(err)
+			}
+			meta := result.(*mcp.CallToolResult).Meta
+			if got, _ := meta[errorCodeMetaKey].(string); got != tc.want {
+				t.Errorf("got error code %q, want %q", got, tc.want)
+			}
+			if tc.want == "" && meta[upstreamCodeMetaKey] != nil {
+				t.Errorf("got upstream code %v on an untagged result", meta[upstreamCodeMetaKey])
+			}
+		})
+	}
+}
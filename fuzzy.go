@@ -0,0 +1,71 @@
+package main
+
+import (
+	"slices"
+	"strings"
+)
+
+// similarity returns how similar a and b are from 0 to 1, based on the Levenshtein distance
+// of their runes ignoring case and surrounding spaces, so it works for Chinese names too.
+func similarity(a, b string) float64 {
+	ra := []rune(strings.ToLower(strings.TrimSpace(a)))
+	rb := []rune(strings.ToLower(strings.TrimSpace(b)))
+	longest := max(len(ra), len(rb))
+	if longest == 0 {
+		return 1
+	}
+	return 1 - float64(levenshtein(ra, rb))/float64(longest)
+}
+
+// levenshtein returns the edit distance between a and b.
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+// fuzzyMatch returns the candidate most similar to query if its similarity reaches threshold,
+// otherwise up to three of the most similar candidates as suggestions.
+func fuzzyMatch(query string, candidates []string, threshold float64) (string, []string) {
+	type scored struct {
+		name  string
+		score float64
+	}
+	var ranked []scored
+	for _, c := range candidates {
+		if !slices.ContainsFunc(ranked, func(s scored) bool { return s.name == c }) {
+			ranked = append(ranked, scored{c, similarity(query, c)})
+		}
+	}
+	slices.SortStableFunc(ranked, func(a, b scored) int {
+		switch {
+		case a.score > b.score:
+			return -1
+		case a.score < b.score:
+			return 1
+		}
+		return 0
+	})
+	if len(ranked) > 0 && ranked[0].score >= threshold {
+		return ranked[0].name, nil
+	}
+	suggestions := make([]string, 0, 3)
+	for _, s := range ranked[:min(3, len(ranked))] {
+		suggestions = append(suggestions, s.name)
+	}
+	return "", suggestions
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestFuzzyMatch(t *testing.T) {
+	candidates := []string{"客厅主灯", "卧室台灯", "厨房灯", "Living Room Lamp", "Bedroom Fan"}
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{"客厅主灯", "客厅主灯"},
+		{"客厅灯", "客厅主灯"},
+		{"卧室灯", "卧室台灯"},
+		{" 厨房的灯 ", "厨房灯"},
+		{"living room lamps", "Living Room Lamp"},
+		{"bedrom fan", "Bedroom Fan"},
+		{"BEDROOM FAN", "Bedroom Fan"},
+	} {
+		best, suggestions := fuzzyMatch(tc.query, candidates, 0.6)
+		if best != tc.want {
+			t.Errorf("fuzzyMatch(%q) = %q %v, want %q", tc.query, best, suggestions, tc.want)
+		}
+	}
+}
+
+func TestFuzzyMatchSuggestions(t *testing.T) {
+	candidates := []string{"客厅主灯", "卧室台灯", "厨房灯", "Living Room Lamp", "Bedroom Fan", "厨房灯"}
+	for _, query := range []string{"车库门", "garage door"} {
+		best, suggestions := fuzzyMatch(query, candidates, 0.6)
+		if best != "" {
+			t.Errorf("fuzzyMatch(%q) matched %q", query, best)
+		}
+		if len(suggestions) != 3 {
+			t.Errorf("fuzzyMatch(%q) suggested %v, want 3 names", query, suggestions)
+		}
+		if unique := slices.Compact(slices.Sorted(slices.Values(suggestions))); len(unique) != len(suggestions) {
+			t.Errorf("fuzzyMatch(%q) suggested a name twice: %v", query, suggestions)
+		}
+	}
+	if _, suggestions := fuzzyMatch("书房灯", candidates, 0.9); suggestions[0] != "厨房灯" {
+		t.Errorf("got suggestions %v, want the most similar first", suggestions)
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want float64
+	}{
+		{"", "", 1},
+		{"客厅灯", "客厅灯", 1},
+		{" Lamp ", "lamp", 1},
+		{"客厅灯", "客厅主灯", 0.75},
+		{"灯", "扇", 0},
+	} {
+		if got := similarity(tc.a, tc.b); got != tc.want {
+			t.Errorf("similarity(%q, %q) = %v, want %v", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// catalogs maps a language to its translations of user-facing messages.
+//
+// Messages are keyed by their English text, and tool descriptions by "tool:<name>",
+// so English needs no catalog and untranslated messages fall back to English.
+var catalogs = map[string]map[string]string{
+	"zh": {
+		"Username cannot be empty":                    "用户名不能为空",
+		"Password cannot be empty":                    "密码不能为空",
+		"Region cannot be empty":                      "区域不能为空",
+		"Logout successful":                           "已退出登录",
+		"Device list cannot be empty":                 "设备列表不能为空",
+		"Control parameters cannot be empty":          "控制参数不能为空",
+		"Device control success":                      "设备控制成功",
+		"No device data available":                    "没有设备数据",
+		"No device status data available":             "没有设备状态数据",
+		"No scenes available":                         "没有可用的场景",
+		"Scene list cannot be empty":                  "场景列表不能为空",
+		"Scene executed successfully":                 "场景执行成功",
+		"Buttons failed: %s":                          "执行失败的按钮：%s",
+		"Buttons succeeded: %s":                       "执行成功的按钮：%s",
+		"No homes available":                          "没有可用的家庭",
+		"No homes found.":                             "没有找到家庭。",
+		"No rooms found.":                             "没有找到房间。",
+		"Home name cannot be empty":                   "家庭名称不能为空",
+		"Home switch failed: no response from server": "切换家庭失败：服务器无响应",
+		"Scheduled time cannot be empty":              "执行时间不能为空",
+		"Task name cannot be empty":                   "任务名称不能为空",
+		"Automation configuration successful":         "定时任务设置成功",
+		"No device log data available":                "没有设备日志数据",
+		"At least one button should be provided":      "至少需要提供一个按钮",
+		"Login failed: no response from server":       "登录失败：服务器无响应",
+		"Unsupported region %q, valid options: %s":    "不支持的区域 %q，可选值：%s",
+		"Successfully switched to home \"%s\"":        "已切换到家庭 \"%s\"",
+		"Switched from home \"%s\" to \"%s\"":         "已从家庭 \"%s\" 切换到 \"%s\"",
+		"This applies to all clients of the account":  "该切换对账号的所有客户端生效",
+		"No current home":                             "没有当前家庭",
+		"Current home: %s":                            "当前家庭：%s",
+		"Successfully logged in, region: %s":          "登录成功，区域：%s",
+		"[DRY RUN] %s was not sent, payload: %s":      "[演练模式] 未发送 %s，请求内容：%s",
+		"Invalid scheduled time %q: %v":               "执行时间 %q 无效：%v",
+		"Invalid time zone %q: %v":                    "时区 %q 无效：%v",
+		"Invalid time %q: %v":                         "时间 %q 无效：%v",
+		"Scheduled as %q in time zone %s":             "已设置为 %q（时区 %s）",
+		"No scheduled tasks found":                    "没有定时任务",
+		"Task id cannot be empty":                     "任务 ID 不能为空",
+		"Failed to cancel task %q: %s":                "取消任务 %q 失败：%s",
+		"Task %q cancelled":                           "已取消任务 %q",
+		"Service name cannot be empty":                "服务名称不能为空",
+		"No device named %q found":                    "没有找到名为 %q 的设备",
+		"No device named %q found, did you mean: %s":  "没有找到名为 %q 的设备，您是否要找：%s",
+		"No room named %q found":                      "没有找到名为 %q 的房间",
+		"No room named %q found, did you mean: %s":    "没有找到名为 %q 的房间，您是否要找：%s",
+		"Request ID: %s":                              "请求 ID：%s",
+		"Device list failed, status only: %s":         "获取设备列表失败，仅显示状态：%s",
+		"Device status failed, devices only: %s":      "获取设备状态失败，仅显示设备：%s",
+		"Multiple devices named %q, pick one by id:":  "有多个名为 %q 的设备，请按 ID 选择：",
+		"Device %d not found":                         "没有找到设备 %d",
+		"%s has no on/off state to toggle":            "%s 没有可切换的开关状态",
+		"%s has no brightness to adjust":              "%s 没有可调节的亮度",
+		"%s brightness %d%% -> %d%%":                  "%s 亮度 %d%% -> %d%%",
+		"%s does not support %s, valid keys: %s":      "%s 不支持 %s，可用的参数：%s",
+		"Calling %s":                                  "正在调用 %s",
+		"Still waiting for %s, %s elapsed":            "仍在等待 %s，已用时 %s",
+		"Too many devices: %d, at most %d per call":   "设备过多：%d 个，每次最多 %d 个",
+		"Devices %v: %s":                              "设备 %v：%s",
+		"Device control failed for some devices:":     "部分设备控制失败：",
+		"%s (%s): unknown":                            "%s（%s）：未知",
+		"%s (%s): online":                             "%s（%s）：在线",
+		"%s (%s): offline":                            "%s（%s）：离线",
+		"%s has no power metering":                    "%s 没有电量计量",
+		"Turned on: %s":                               "已打开：%s",
+		"Turned off: %s":                              "已关闭：%s",
+		"Could not verify the device state: %s":       "无法确认设备状态：%s",
+		"The new state may not have propagated yet":   "新状态可能尚未同步",
+		"%s is now %s":                                "%s 现在为 %s",
+		"No button named %q found":                    "没有找到名为 %q 的按钮",
+		"No button named %q found, did you mean: %s":  "没有找到名为 %q 的按钮，您是否要找：%s",
+		"Multiple buttons named %q, pick one by id:":  "有多个名为 %q 的按钮，请按 ID 选择：",
+		"More logs may follow, next offset %d":        "可能还有更多日志，下一页偏移量 %d",
+		"Home switch failed due to an unknown error.": "切换家庭失败：未知错误。",
+		"No buttons found in room %q matching %q":     "房间 %q 中没有匹配 %q 的按钮",
+		"Multiple buttons in room %q, set a filter:":  "房间 %q 中有多个按钮，请指定筛选条件：",
+		"rgb needs 3 values, got %d":                  "rgb 需要 3 个值，实际为 %d 个",
+		"rgb value %d out of range 0-255":             "rgb 值 %d 超出范围 0-255",
+		"brightness %d out of range 0-100":            "亮度 %d 超出范围 0-100",
+		"color temperature %dK out of range %d-%dK":   "色温 %dK 超出范围 %d-%dK",
+		"Failed to decode %s result: %v":              "解析 %s 结果失败：%v",
+		"brightness change %q needs a + or - sign":    "亮度变化 %q 需要 + 或 - 号",
+		"invalid brightness change %q, e.g. +10%%":    "亮度变化 %q 无效，例如 +10%%",
+		"brightness change %q exceeds 100%%":          "亮度变化 %q 超过 100%%",
+		"Version: %s":                                 "版本：%s",
+		"App ID: %s":                                  "应用 ID：%s",
+		"Device ID: %s":                               "设备 ID：%s",
+		"Region: %s":                                  "区域：%s",
+		"Transport: %s":                               "传输方式：%s",
+		"tool:list_homes":                             "获取用户的所有家庭（用于查询或切换家庭）。\n返回：\n家庭名称列表，没有数据时返回空或提示信息。",
+		"tool:get_current_home":                       "获取用户当前的家庭，即设备和场景工具操作的家庭（用于在控制设备前确认家庭）。\n返回：\n  当前家庭的名称。",
+		"tool:switch_home":                            "切换用户当前的家庭。该切换对账号的所有客户端生效，仅需确认时请使用 get_current_home。\n返回：\n切换结果信息。",
+		"tool:list_device_control_buttons":            "获取用户家中的所有设备控制按钮。\n返回：\n  Markdown 格式的控制按钮信息，或按要求返回 JSON",
+		"tool:push_device_control_button":             "按下用户家中的设备控制按钮，或指定房间中的控制按钮。\n返回：\n  按钮执行结果信息。",
+		"tool:control_device":                         "直接控制用户家中的设备，例如开关、亮度或颜色。\n返回：\n  设备控制结果信息。",
+		"tool:set_light":                              "设置用户家中的灯：开关、亮度、色温或颜色。\n返回：\n  设备控制结果信息。",
+		"tool:list_rooms":                             "获取用户当前家庭中的所有房间（位置），即筛选设备时可用的位置。\n返回：\n  每行一个房间名称，或按要求返回 JSON。",
+		"tool:toggle_device":                          "切换用户家中设备的开关状态：打开的关闭，关闭的打开，例如“切换卧室灯”。\n返回：\n  已打开和已关闭的设备，以及没有开关状态的设备。",
+		"tool:dim_device":                             "相对当前亮度调节用户家中灯的亮度，例如“+10%”调亮或“-20%”调暗。\n返回：\n  每个设备的新亮度，以及没有亮度的设备。",
+		"tool:query_devices":                          "查询用户家中的设备，可按位置（房间）和设备类型筛选。\n返回：\n  Markdown 格式的设备信息，或按要求返回 JSON",
+		"tool:query_device_status":                    "查询用户家中设备的当前状态，可按位置（房间）和设备类型筛选。\n返回：\n  Markdown 格式的设备状态信息，或按要求返回 JSON",
+		"tool:run_scene_by_name":                      "按名称按下用户家中的设备控制按钮，例如“观影模式”，无需知道按钮 ID。\n返回：\n  按钮执行结果信息，名称不明确时返回候选按钮。",
+		"tool:get_device":                             "按名称获取用户家中单个设备的当前状态，例如卧室台灯是否打开。\n返回：\n  Markdown 格式或按要求返回 JSON 的设备状态信息，名称不明确时返回候选设备。",
+		"tool:home_snapshot":                          "一次获取用户家中的所有设备及其当前状态，例如了解家里的整体状态。\n返回：\n  Markdown 格式的设备及状态信息，或按要求返回 JSON。",
+		"tool:schedule_device_task":                   "为用户家中的设备设置定时控制任务，例如晚上11点关闭客厅灯。\n返回：\n  定时任务设置结果信息。",
+		"tool:list_scheduled_tasks":                   "列出用户家中的定时设备控制任务，例如查找要取消的任务。\n返回：\n  Markdown 格式的任务信息，包含任务 ID。",
+		"tool:cancel_scheduled_task":                  "取消用户家中的定时设备控制任务，例如晚上11点的任务。\n返回：\n  任务取消结果信息。",
+		"tool:server_info":                            "获取本服务的版本和身份信息，用于排查正在运行的版本。\n返回：\n  服务版本、应用 ID、设备 ID 前缀、账号区域和传输方式。",
+		"tool:call_service":                           "按名称使用原始参数调用云服务，用于没有专用工具的服务。有合适的专用工具时优先使用专用工具。\n返回：\n  服务的原始 JSON 结果。",
+		"tool:query_device_logs":                      "查询用户家中设备在指定时间范围内的历史日志。\n返回：\n  Markdown 格式的设备日志信息",
+		"tool:online_status":                          "查询用户家中的设备是否在线，例如在相信传感器读数前确认它是否离线。\n返回：\n  每个设备的在线、离线状态，设备未上报可达性时为未知。",
+		"tool:query_power":                            "查询用户家中设备的功率和用电量，例如空调用了多少电，可附带指定时间范围内的计量日志。\n返回：\n  每个有计量的设备的瓦数和千瓦时、没有电量计量的设备，以及指定时间范围时的计量日志。",
+		"tool:login":                                  "使用用户名和密码登录指定区域的账号。\n返回：\n  成功时返回账号区域，失败时返回错误信息。",
+		"tool:logout":                                 "退出当前账号，使其会话令牌失效。\n返回：\n  退出结果信息。",
+	},
+}
+
+// lookup finds the translation of key for lang, following the chain
+// "zh-CN" -> "zh" and returning false if none is found.
+func lookup(lang, key string) (string, bool) {
+	lang = strings.ToLower(strings.ReplaceAll(lang, "_", "-"))
+	// Drop encodings like "zh_CN.UTF-8".
+	lang, _, _ = strings.Cut(lang, ".")
+	for lang != "" {
+		if v, ok := catalogs[lang][key]; ok {
+			return v, true
+		}
+		i := strings.LastIndex(lang, "-")
+		if i < 0 {
+			break
+		}
+		lang = lang[:i]
+	}
+	return "", false
+}
+
+// headerLang converts a LANG setting like "zh_CN.UTF-8" into a language tag like "zh-CN"
+// for the API headers. Unset and POSIX locales map to "en".
+func headerLang(lang string) string {
+	lang, _, _ = strings.Cut(lang, ".")
+	lang, _, _ = strings.Cut(lang, "@")
+	if lang == "" || lang == "C" || lang == "POSIX" {
+		return "en"
+	}
+	base, region, ok := strings.Cut(strings.ReplaceAll(lang, "_", "-"), "-")
+	if !ok {
+		return strings.ToLower(base)
+	}
+	return strings.ToLower(base) + "-" + strings.ToUpper(region)
+}
+
+// tr translates the English message into the configured LANG, formatting it with args if any.
+func tr(msg string, args ...any) string {
+	if v, ok := lookup(LANG, msg); ok {
+		msg = v
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+// localizeTool returns a copy of the tool with its description in the configured LANG.
+func localizeTool(tool *mcp.Tool) *mcp.Tool {
+	t := *tool
+	if v, ok := lookup(LANG, "tool:"+tool.Name); ok {
+		t.Description = v
+	}
+	return &t
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCatalogVerbs(t *testing.T) {
+	verbs := regexp.MustCompile(`%[-+# 0]*\d*[a-zA-Z%]`)
+	for lang, catalog := range catalogs {
+		for key, value := range catalog {
+			if strings.HasPrefix(key, "tool:") {
+				continue
+			}
+			if want, got := verbs.FindAllString(key, -1), verbs.FindAllString(value, -1); !slices.Equal(got, want) {
+				t.Errorf("%s translation of %q has verbs %v, want %v", lang, key, got, want)
+			}
+		}
+	}
+}
+
+func TestTr(t *testing.T) {
+	setForTest(t, &LANG, "zh_CN.UTF-8")
+	if got := tr("brightness %d out of range 0-100", 120); got != "亮度 120 超出范围 0-100" {
+		t.Errorf("got %q, want the zh translation", got)
+	}
+	if got := tr("Not in any catalog %d", 1); got != "Not in any catalog 1" {
+		t.Errorf("got %q, want the English fallback", got)
+	}
+}
+
+func TestServerInfoTranslated(t *testing.T) {
+	setForTest(t, &LANG, "zh")
+	result, _, _ := HandleServerInfo(context.Background(), toolRequest(), struct{}{})
+	text := contentText(t, result)
+	for _, label := range []string{"版本：" + Version, "应用 ID：", "设备 ID：", "区域：", "传输方式："} {
+		if !strings.Contains(text, label) {
+			t.Errorf("server info %q lacks %q", text, label)
+		}
+	}
+}
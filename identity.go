@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/devfans/golang/log"
+)
+
+// identity is the device and app id the server reports to the cloud service.
+type identity struct {
+	DeviceID string `json:"device_id"`
+	AppID    string `json:"app_id"`
+}
+
+// defaultIdentityFile returns the identity file under the user config directory, or empty if there is none.
+func defaultIdentityFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "yalla-mcp", "identity.json")
+}
+
+// loadIdentity returns the identity persisted at path, generating and persisting it on first run,
+// so it stays stable across restarts even when the host MAC or hostname change.
+//
+// DEVICE_ID takes precedence over the file, and the identity is generated without being
+// persisted when path is empty or cannot be written. A corrupt file is renamed with a
+// ".corrupt" suffix and replaced.
+func loadIdentity(path string) identity {
+	if DEVICE_ID != "" || path == "" {
+		deviceID := genDeviceID()
+		return identity{DeviceID: deviceID, AppID: genAppID(deviceID)}
+	}
+	if id, err := readIdentity(path); err == nil {
+		return id
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		// Move the unreadable file aside so the new identity can take its place, keeping it
+		// around for inspection.
+		if renameErr := os.Rename(path, path+".corrupt"); renameErr != nil {
+			log.Warn("Failed to read identity file, generating a new identity", "path", path, "err", err, "rename_err", renameErr)
+		} else {
+			log.Warn("Moved corrupt identity file aside, generating a new identity", "path", path, "moved_to", path+".corrupt", "err", err)
+		}
+	}
+
+	deviceID := genDeviceID()
+	id := identity{DeviceID: deviceID, AppID: genAppID(deviceID)}
+	err := writeIdentity(path, id)
+	if errors.Is(err, fs.ErrExist) {
+		// Another process started at the same time and persisted its identity first, use that one.
+		if existing, err := readIdentity(path); err == nil {
+			return existing
+		}
+	} else if err != nil {
+		log.Warn("Failed to persist identity", "path", path, "err", err)
+	} else {
+		log.Info("Persisted identity", "path", path, "device_id", id.DeviceID)
+	}
+	return id
+}
+
+// readIdentity reads a persisted identity, failing if it is incomplete.
+func readIdentity(path string) (identity, error) {
+	var id identity
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return id, err
+	}
+	if err := json.Unmarshal(data, &id); err != nil {
+		return id, err
+	}
+	if id.DeviceID == "" || id.AppID == "" {
+		return id, errors.New("identity file is incomplete")
+	}
+	return id, nil
+}
+
+// writeIdentity persists id at path, failing with fs.ErrExist if the file already exists.
+//
+// The file is written to a temporary file first and then hard linked into place, so readers
+// never see a partial file and concurrent first starts agree on a single identity.
+func writeIdentity(path string, id identity) error {
+	data, err := json.MarshalIndent(id, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".identity-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Link(tmp.Name(), path)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeviceIDOverride(t *testing.T) {
+	setForTest(t, &DEVICE_ID, "")
+	generated := genDeviceID()
+	if !strings.HasPrefix(generated, "mcp") || generated != genDeviceID() {
+		t.Fatalf("got generated ids %q and %q, want a stable mcp-prefixed id", generated, genDeviceID())
+	}
+
+	setForTest(t, &DEVICE_ID, "my-device")
+	if got := genDeviceID(); got != "my-device" {
+		t.Errorf("got %q, want the DEVICE_ID override", got)
+	}
+
+	path := filepath.Join(t.TempDir(), "identity.json")
+	id := loadIdentity(path)
+	if id.DeviceID != "my-device" || id.AppID != genAppID("my-device") {
+		t.Errorf("got identity %+v, want the DEVICE_ID override", id)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("identity persisted with DEVICE_ID set: %v", err)
+	}
+}
+
+func TestLoadIdentity(t *testing.T) {
+	setForTest(t, &DEVICE_ID, "")
+	path := filepath.Join(t.TempDir(), "identity.json")
+
+	id := loadIdentity(path)
+	if id.DeviceID == "" || id.AppID == "" {
+		t.Fatalf("got identity %+v, want one generated", id)
+	}
+	if again := loadIdentity(path); again != id {
+		t.Errorf("got identity %+v after restart, want the persisted %+v", again, id)
+	}
+
+	if err := os.WriteFile(path, []byte("{not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	logs := captureLogs(t)
+	id = loadIdentity(path)
+	if persisted, err := readIdentity(path); err != nil || persisted != id {
+		t.Errorf("got persisted identity %+v %v, want the new %+v", persisted, err, id)
+	}
+	if data, err := os.ReadFile(path + ".corrupt"); err != nil || string(data) != "{not json" {
+		t.Errorf("corrupt file not kept aside: %q %v", data, err)
+	}
+	if output := logs(); !strings.Contains(output, "corrupt") {
+		t.Errorf("corrupt file not logged:\n%s", output)
+	}
+}
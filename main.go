@@ -1,63 +1,297 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"os"
+	"slices"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/devfans/envconf/dotenv"
 	"github.com/devfans/golang/log"
 	"github.com/modelcontextprotocol/go-sdk/auth"
 	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 
 var (
 	host = dotenv.String("host", "127.0.0.1")
 	port = dotenv.String("port", "8080")
+	allowedOrigins = parseList(dotenv.String("ALLOWED_ORIGINS"))
+	redactKeys = parseList(strings.ToLower(dotenv.String("REDACT_KEYS", "password,token,secret,api_key")))
+	tokenTTL = durationEnv("TOKEN_TTL", DefaultTokenTTL)
+	transport = flag.String("transport", dotenv.String("TRANSPORT", "sse"), "transport to serve MCP over: sse, websocket or stdio")
 )
 
+// apiToken is a bearer token accepted from MCP clients along with the identity it was issued to.
+type apiToken struct {
+	Identity string
+	Token    string
+}
+
+var apiTokens = parseAPITokens(dotenv.String("API_TOKENS"), API_TOKEN)
+
+// parseAPITokens parses a comma-separated list of "identity:token" or bare "token" entries,
+// falling back to the single API_TOKEN when the list is empty.
+func parseAPITokens(list, fallback string) []apiToken {
+	var tokens []apiToken
+	for i, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		identity, token, ok := strings.Cut(entry, ":")
+		if !ok {
+			identity, token = fmt.Sprintf("token-%d", i), entry
+		}
+		tokens = append(tokens, apiToken{Identity: strings.TrimSpace(identity), Token: strings.TrimSpace(token)})
+	}
+	if len(tokens) == 0 && fallback != "" {
+		tokens = append(tokens, apiToken{Identity: "default", Token: fallback})
+	}
+	return tokens
+}
+
+// DefaultTokenTTL is the expiration of verified bearer tokens unless TOKEN_TTL is set.
+const DefaultTokenTTL = time.Hour * 24 * 365 * 10
+
 const INSTRUCTION = `
 reconnect to this mcp server when encounter issues like "invalid during session initialization" during calls
 `
 
+// parseList splits a comma-separated setting into trimmed non-empty values.
+func parseList(value string) []string {
+	var list []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
 func enableCORS(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Add("Access-Control-Allow-Origin", "*")
-		w.Header().Add("Access-Control-Allow-Credentials", "true")
-		w.Header().Add("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
-		w.Header().Add("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		if len(allowedOrigins) == 0 {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else if origin := r.Header.Get("Origin"); origin != "" && slices.Contains(allowedOrigins, origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		w.Header().Add("Vary", "Origin")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, X-Request-ID")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
 		log.Debug("HTTP request", "method", r.Method, "path", r.URL.RawPath)
 		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// correlationMiddleware passes the client's X-Request-ID of a POSTed message on to the tool
+// calls it holds, tagging it into their _meta since the SSE transport does not hand the HTTP
+// request to the MCP handlers. Invalid ids are ignored.
+func correlationMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(CorrelationHeader)
+		if r.Method != http.MethodPost || id == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if !validCorrelationID(id) {
+			log.Warn("Ignoring invalid correlation id", "header", CorrelationHeader)
+			handler.ServeHTTP(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, "failed to read body", http.StatusBadRequest)
 			return
 		}
+		body = tagCorrelationID(body, id)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
 		handler.ServeHTTP(w, r)
 	})
 }
 
+// handleHealthz reports the server is up.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// handleReadyz reports the server is ready once the app secret has been obtained.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if !AppSecrets.Ready() {
+		http.Error(w, "app secret not available", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// setLogLevel sets the minimum level of logs, one of TRACE, DEBUG, VERBO, INFO, WARN or ERROR.
+func setLogLevel(level string) {
+	if !slices.Contains(log.Levels[:], strings.ToUpper(level)) {
+		log.Error("Invalid LOG_LEVEL, using INFO", "value", level, "valid", strings.Join(log.Levels[:], ","))
+	}
+	log.SetLevel(log.ParseLevel(level))
+}
+
+// verifyAuth checks a bearer token against the configured API tokens.
+//
+// Tokens are compared in constant time, on their SHA-256 digests so neither the length
+// nor the position of a mismatch leaks, and every configured token is checked.
+// Tokens are never logged, only a short hash of the presented token to correlate attempts.
 func verifyAuth(ctx context.Context, token string) (*auth.TokenInfo, error) {
-	log.Debug("Token verification request", token, API_TOKEN)
-	if token == API_TOKEN {
-		return &auth.TokenInfo{
-			Expiration: time.Now().Add(time.Hour * 24 * 365 * 10),
-		}, nil
+	digest := sha256.Sum256([]byte(token))
+	var matched *apiToken
+	for i := range apiTokens {
+		expected := sha256.Sum256([]byte(apiTokens[i].Token))
+		if subtle.ConstantTimeCompare(digest[:], expected[:]) == 1 && matched == nil {
+			matched = &apiTokens[i]
+		}
+	}
+	if matched == nil || matched.Token == "" {
+		log.Debug("Token rejected", "token_hash", tokenHash(token))
+		return nil, fmt.Errorf("%w: invalid api key", auth.ErrInvalidToken)
 	}
-	return nil, errors.New("invalid api key")
+	log.Debug("Token verified", "token_hash", tokenHash(token), "identity", matched.Identity)
+	return &auth.TokenInfo{
+		Expiration: time.Now().Add(tokenTTL),
+		Extra:      map[string]any{"identity": matched.Identity},
+	}, nil
+}
+
+// tokenHash returns a short SHA-256 prefix of token, safe to log.
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:4])
 }
 
 func simpleResult(args ...string) *mcp.CallToolResult {
 	contents := make([]mcp.Content, len(args))
 	for i, v := range args {
-		contents[i] =  &mcp.TextContent{Text: v} 
+		contents[i] =  &mcp.TextContent{Text: truncateText(v, int(MAX_RESULT_BYTES))} 
 	}
 	return &mcp.CallToolResult{
 			Content: contents,
 		}
 }
 
+// Result formats of the query tools. Markdown suits models, JSON suits programmatic clients.
+const (
+	formatMarkdown = "markdown"
+	formatJSON     = "json"
+)
+
+var resultFormats = []string{formatMarkdown, formatJSON}
+
+// resultText returns markdown, or v encoded as JSON if format is "json".
+func resultText(format string, v any, markdown string) string {
+	if format != formatJSON {
+		return markdown
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Error("Failed to encode result as JSON", "err", err)
+		return markdown
+	}
+	return string(data)
+}
+
+// truncateText cuts text down to at most limit bytes on a UTF-8 boundary, marking how much was omitted.
+// A non-positive limit disables truncation.
+func truncateText(text string, limit int) string {
+	if limit <= 0 || len(text) <= limit {
+		return text
+	}
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return text[:cut] + fmt.Sprintf("\n...(truncated, %d bytes omitted)", len(text)-cut)
+}
+
+// errorResult builds a tool result flagged as failed, so clients can tell failures from normal output.
+func errorResult(msg string) *mcp.CallToolResult {
+	result := simpleResult(msg)
+	result.IsError = true
+	return result
+}
+
+// redactArgs returns tool call arguments for logging with sensitive values masked.
+func redactArgs(args any) any {
+	raw, ok := args.(json.RawMessage)
+	if !ok {
+		return args
+	}
+	var fields any
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return args
+	}
+	return redactValue(fields)
+}
+
+// redactValue masks values of keys matching redactKeys, descending into nested maps and lists.
+func redactValue(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, field := range v {
+			if isSensitiveKey(key) {
+				v[key] = "***"
+			} else {
+				v[key] = redactValue(field)
+			}
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = redactValue(item)
+		}
+	}
+	return value
+}
+
+// isSensitiveKey reports whether the key contains any of redactKeys, case-insensitively.
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, k := range redactKeys {
+		if strings.Contains(key, k) {
+			return true
+		}
+	}
+	return false
+}
+
 func main() {
+	flag.Parse()
+	setLogLevel(LOG_LEVEL)
+	log.Info("Server info", "version", Version, "app_id", AppID, "device_id", deviceIDPrefix(DeviceID), "region", LOGIN_REGION, "transport", *transport)
+	if DEFAULT_REGION != "" && !slices.Contains(SupportedRegions, DEFAULT_REGION) {
+		log.Fatal("Invalid DEFAULT_REGION", "value", DEFAULT_REGION, "supported", SupportedRegions)
+	}
+	if tokenTTL <= 0 {
+		log.Error("Invalid TOKEN_TTL, must be positive, using default", "value", tokenTTL, "default", DefaultTokenTTL)
+		tokenTTL = DefaultTokenTTL
+	}
 	loggingMiddleware := func(next mcp.MethodHandler) mcp.MethodHandler {
 		return func(
 			ctx context.Context,
@@ -69,20 +303,39 @@ func main() {
 				"session_id", req.GetSession().ID(),
 				"has_params", req.GetParams() != nil,
 			)
-			// Log more for tool calls.
+			// Log more for tool calls, and give each one a request id shared by its upstream calls.
+			requestID := ""
 			if ctr, ok := req.(*mcp.CallToolRequest); ok {
+				requestID = newRequestID()
+				ctx = withRequestID(ctx, requestID)
+				if id := correlationID(ctr); id != "" {
+					ctx = withCorrelationID(ctx, id)
+				}
 				log.Info("Calling tool",
 					"name", ctr.Params.Name,
-					"args", ctr.Params.Arguments)
+					"home", homeName(req.GetSession()),
+					"request_id", requestID,
+					"correlation_id", correlationIDFromContext(ctx),
+					"args", redactArgs(ctr.Params.Arguments))
 			}
 
 			start := time.Now()
+			inflightRequests.Inc()
 			result, err := next(ctx, method, req)
+			inflightRequests.Dec()
 			duration := time.Since(start)
+			observeToolCall(req, result, err, duration)
+			if r, ok := result.(*mcp.CallToolResult); ok && r != nil && r.IsError && requestID != "" {
+				// Let users reference the failed call when reporting it.
+				r.Content = append(r.Content, &mcp.TextContent{Text: tr("Request ID: %s", requestID)})
+			}
 			if err != nil {
 				log.Error("MCP method failed",
 					"method", method,
 					"session_id", req.GetSession().ID(),
+					"request_id", requestID,
+					"correlation_id", correlationIDFromContext(ctx),
+					"home", homeName(req.GetSession()),
 					"duration_ms", duration.Milliseconds(),
 					"err", err,
 				)
@@ -90,6 +343,9 @@ func main() {
 				log.Info("MCP method completed",
 					"method", method,
 					"session_id", req.GetSession().ID(),
+					"request_id", requestID,
+					"correlation_id", correlationIDFromContext(ctx),
+					"home", homeName(req.GetSession()),
 					"duration_ms", duration.Milliseconds(),
 					"has_result", result != nil,
 				)
@@ -99,18 +355,146 @@ func main() {
 	}
 	// Create a server with a single tool that says "Hi".
 	server := mcp.NewServer(&mcp.Implementation{Name: "yalla"}, &mcp.ServerOptions{Instructions: INSTRUCTION})
-	server.AddReceivingMiddleware(loggingMiddleware)
+	// The first middleware is the outermost, rate limited calls are still logged.
+	middlewares := []mcp.Middleware{loggingMiddleware}
+	if RATE_LIMIT_RPS > 0 {
+		middlewares = append(middlewares, rateLimitMiddleware(newRateLimiter(RATE_LIMIT_RPS, int(RATE_LIMIT_BURST), RATE_LIMIT_IDLE_TTL, 1024)))
+	}
+	middlewares = append(middlewares, tracingMiddleware, errorCodeMiddleware, sessionMiddleware, progressMiddleware)
+	server.AddReceivingMiddleware(middlewares...)
 	registerTools(server)
+	// Warm up the app secret in the background, readiness is reported once it succeeds,
+	// then switch to the default home if configured, without blocking startup.
+	go func() {
+		AppSecrets.Warmup(context.Background(), int(SECRET_RETRIES), SECRET_RETRY_DELAY)
+		if DEFAULT_HOME != "" {
+			switchDefaultHome(context.Background(), DEFAULT_HOME, DEFAULT_HOME_REGION, int(DEFAULT_HOME_RETRIES), DEFAULT_HOME_RETRY_DELAY)
+		}
+	}()
+
+	if METRICS_ADDR != "" {
+		go serveMetrics(METRICS_ADDR)
+	}
+	shutdownTracer, err := setupTracing(context.Background())
+	if err != nil {
+		log.Fatal("Failed to set up tracing", "err", err)
+	}
+	defer shutdownTracing(shutdownTracer)
+
+	switch *transport {
+	case "stdio":
+		// Serve a single session over stdin/stdout, as launched by local MCP clients.
+		log.Info("Server will start", "transport", *transport)
+		if err := server.Run(context.Background(), mcp.NewStdioTransport()); err != nil {
+			log.Fatal("Server stopped", "err", err)
+		}
+	case "sse":
+		serveSSE(server)
+	case "websocket":
+		serveHTTP(newWebSocketHandler(server))
+	default:
+		log.Fatal("Unsupported transport", "transport", *transport)
+	}
+}
 
-	// server.Run runs the server on the given transport.
-	//
-	// In this case, the server communicates over stdin/stdout.
-	handler := mcp.NewSSEHandler(func(request *http.Request) *mcp.Server {
+// switchDefaultHome switches to home at startup, retrying up to attempts times with
+// exponential backoff from delay. A failure is only logged, the server keeps running
+// with whatever home is current.
+func switchDefaultHome(ctx context.Context, home, region string, attempts int, delay time.Duration) bool {
+	for i := 0; ; i++ {
+		success, message := SwitchHome(ctx, home, region)
+		if success {
+			log.Info("Switched to default home", "home", home, "region", region)
+			return true
+		}
+		if i+1 >= attempts {
+			log.Warn("Failed to switch to default home", "home", home, "region", region, "attempts", attempts, "message", message)
+			return false
+		}
+		log.Warn("Retrying default home switch", "home", home, "attempt", i+1, "delay", delay, "message", message)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// serveSSE serves the MCP server over HTTP with SSE, behind CORS and bearer token auth.
+func serveSSE(server *mcp.Server) {
+	serveHTTP(mcp.NewSSEHandler(func(request *http.Request) *mcp.Server {
 		return server
-	})
-	addr := fmt.Sprintf("%s:%s", host, port)
-	log.Info("Server will start", "url", addr)
-	if err := http.ListenAndServe(addr, enableCORS(auth.RequireBearerToken(verifyAuth, nil)(handler))); err != nil {
+	}))
+}
+
+// serveHTTP serves the MCP handler behind CORS and bearer token auth, along with the probes
+// and metrics.
+func serveHTTP(handler http.Handler) {
+	// Probes are registered ahead of the catch-all MCP handler so they bypass auth.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+	if METRICS_ADDR == "" {
+		mux.Handle(METRICS_PATH, promhttp.Handler())
+	}
+	mux.Handle("/", enableCORS(auth.RequireBearerToken(verifyAuth, nil)(correlationMiddleware(handler))))
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		log.Fatal("Invalid TLS configuration", "err", err)
+	}
+	listener, err := listen()
+	if err != nil {
 		log.Fatal("Failed to listen", "err", err)
 	}
+	httpServer := &http.Server{Handler: mux, TLSConfig: tlsConfig}
+	if tlsConfig != nil {
+		log.Info("Server will start", "transport", *transport, "url", listener.Addr(), "tls", TLS_MIN_VERSION)
+		err = httpServer.ServeTLS(listener, TLS_CERT_FILE, TLS_KEY_FILE)
+	} else {
+		log.Info("Server will start", "transport", *transport, "url", listener.Addr())
+		err = httpServer.Serve(listener)
+	}
+	if err != nil {
+		log.Fatal("Server stopped", "err", err)
+	}
+}
+
+// newTLSConfig returns the TLS configuration when TLS_CERT_FILE and TLS_KEY_FILE are both set,
+// or nil to serve plain HTTP when neither is.
+func newTLSConfig() (*tls.Config, error) {
+	if TLS_CERT_FILE == "" && TLS_KEY_FILE == "" {
+		return nil, nil
+	}
+	if TLS_CERT_FILE == "" || TLS_KEY_FILE == "" {
+		return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	versions := map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+	minVersion, ok := versions[TLS_MIN_VERSION]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TLS_MIN_VERSION %q, valid options: 1.0, 1.1, 1.2, 1.3", TLS_MIN_VERSION)
+	}
+	return &tls.Config{MinVersion: minVersion}, nil
+}
+
+// listen listens on the Unix socket LISTEN_SOCKET when set, replacing a stale socket file
+// left by a previous run, otherwise on host:port.
+func listen() (net.Listener, error) {
+	if LISTEN_SOCKET == "" {
+		return net.Listen("tcp", net.JoinHostPort(host, port))
+	}
+	if info, err := os.Stat(LISTEN_SOCKET); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", LISTEN_SOCKET)
+		}
+		if err := os.Remove(LISTEN_SOCKET); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	}
+	return net.Listen("unix", LISTEN_SOCKET)
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/modelcontextprotocol/go-sdk/auth"
+)
+
+func TestTruncateText(t *testing.T) {
+	for _, tc := range []struct {
+		text  string
+		limit int
+		want  string
+	}{
+		{"hello", 0, "hello"},
+		{"hello", 5, "hello"},
+		{"hello world", 5, "hello\n...(truncated, 6 bytes omitted)"},
+		// Each of these characters takes 3 bytes, a cut inside one moves back to its start.
+		{"客厅灯", 4, "客\n...(truncated, 6 bytes omitted)"},
+		{"客厅灯", 5, "客\n...(truncated, 6 bytes omitted)"},
+		{"客厅灯", 6, "客厅\n...(truncated, 3 bytes omitted)"},
+		{"客厅灯", 2, "\n...(truncated, 9 bytes omitted)"},
+	} {
+		got := truncateText(tc.text, tc.limit)
+		if got != tc.want {
+			t.Errorf("truncateText(%q, %d) = %q, want %q", tc.text, tc.limit, got, tc.want)
+		}
+		if kept, _, _ := strings.Cut(got, "\n...("); !utf8.ValidString(kept) {
+			t.Errorf("truncateText(%q, %d) cut a character: %q", tc.text, tc.limit, kept)
+		}
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	args := json.RawMessage(`{"name":"lamp","API_TOKEN":"t0k3n","nested":{"password":"hunter2"},"list":[{"client_secret":"s3cr3t"}]}`)
+	data, err := json.Marshal(redactArgs(args))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logged := string(data)
+	for _, secret := range []string{"t0k3n", "hunter2", "s3cr3t"} {
+		if strings.Contains(logged, secret) {
+			t.Errorf("%q not redacted: %s", secret, logged)
+		}
+	}
+	if !strings.Contains(logged, `"name":"lamp"`) {
+		t.Errorf("non-sensitive argument redacted: %s", logged)
+	}
+}
+
+func TestVerifyAuthNeverLogsToken(t *testing.T) {
+	const token = "api-t0k3n-do-not-log"
+	setForTest(t, &apiTokens, parseAPITokens("", token))
+	logs := captureLogs(t)
+
+	verifyAuth(context.Background(), token)
+	verifyAuth(context.Background(), "wrong-attempt")
+	output := logs()
+	if !strings.Contains(output, tokenHash(token)) {
+		t.Fatalf("verification not logged:\n%s", output)
+	}
+	for _, secret := range []string{token, "wrong-attempt"} {
+		if strings.Contains(output, secret) {
+			t.Errorf("token %q logged:\n%s", secret, output)
+		}
+	}
+}
+
+func TestVerifyAuth(t *testing.T) {
+	const token = "api-t0k3n-do-not-log"
+	setForTest(t, &apiTokens, parseAPITokens("", token))
+	handler := auth.RequireBearerToken(verifyAuth, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func(token string) int {
+		request := httptest.NewRequest(http.MethodPost, "/", nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	info, err := verifyAuth(context.Background(), token)
+	if err != nil || info.Extra["identity"] != "default" {
+		t.Fatalf("got %+v %v, want the token verified", info, err)
+	}
+	if code := serve(token); code != http.StatusOK {
+		t.Errorf("valid token: got status %d", code)
+	}
+	for _, invalid := range []string{"", "wrong", token + "x", token[:len(token)-1]} {
+		if _, err := verifyAuth(context.Background(), invalid); err == nil {
+			t.Errorf("token %q verified", invalid)
+		}
+		if code := serve(invalid); code != http.StatusUnauthorized {
+			t.Errorf("invalid token %q: got status %d", invalid, code)
+		}
+	}
+
+	setForTest(t, &tokenTTL, -time.Minute)
+	if code := serve(token); code != http.StatusUnauthorized {
+		t.Errorf("expired token: got status %d", code)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Column headers of the backend's Markdown tables, normalized by normalizeHeader, append to
+// them to support headers named differently. Columns matching none of them are kept as
+// device attributes.
+var (
+	IDHeaders         = []string{"id", "endpoint id", "device id", "scene id", "button id", "设备id", "场景id", "按钮id", "编号"}
+	NameHeaders       = []string{"name", "device name", "scene name", "button name", "名称", "设备名称", "场景名称", "按钮名称"}
+	PositionHeaders   = []string{"position", "position name", "room", "位置", "房间"}
+	TypeHeaders       = []string{"type", "device type", "类型", "设备类型"}
+	AttributesHeaders = []string{"attributes", "属性"}
+)
+
+// markdownRow is a row of a Markdown table, its cells keyed by the column headers.
+type markdownRow map[string]string
+
+var separatorCell = regexp.MustCompile(`^:?-+:?$`)
+
+// parseMarkdownTables returns the rows of the Markdown tables in text, skipping any other line.
+// It fails if text is not empty but has no table.
+func parseMarkdownTables(text string) ([]markdownRow, error) {
+	if strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+	var (
+		rows   []markdownRow
+		header []string
+		found  bool
+	)
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "|") {
+			// A table ends at the first line outside of it.
+			header = nil
+			continue
+		}
+		cells := splitRow(line)
+		switch {
+		case header == nil:
+			header = cells
+		case isSeparator(cells):
+			found = true
+		default:
+			row := make(markdownRow, len(header))
+			for i, name := range header {
+				if i < len(cells) && name != "" {
+					row[name] = cells[i]
+				}
+			}
+			rows = append(rows, row)
+		}
+	}
+	if !found {
+		return nil, errors.New("no Markdown table found")
+	}
+	return rows, nil
+}
+
+// splitRow returns the trimmed cells of a Markdown table row.
+func splitRow(line string) []string {
+	line = strings.TrimSuffix(strings.TrimPrefix(line, "|"), "|")
+	cells := strings.Split(line, "|")
+	for i, cell := range cells {
+		cells[i] = strings.TrimSpace(cell)
+	}
+	return cells
+}
+
+// isSeparator reports whether cells are the delimiter row under a table header.
+func isSeparator(cells []string) bool {
+	for _, cell := range cells {
+		if !separatorCell.MatchString(cell) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeHeader lowercases a column header and turns underscores and dashes into spaces,
+// so "Device_Name" matches "device name".
+func normalizeHeader(header string) string {
+	header = strings.NewReplacer("_", " ", "-", " ").Replace(strings.ToLower(header))
+	return strings.Join(strings.Fields(header), " ")
+}
+
+// take removes and returns the cell of row whose header is one of headers, the first one
+// listed if several are.
+func (row markdownRow) take(headers []string) (string, bool) {
+	for _, header := range headers {
+		for name, value := range row {
+			if normalizeHeader(name) == header {
+				delete(row, name)
+				return value, true
+			}
+		}
+	}
+	return "", false
+}
+
+// id removes and returns the id cell of row, failing if it is missing or not a number.
+func (row markdownRow) id() (int, error) {
+	value, ok := row.take(IDHeaders)
+	if !ok {
+		return 0, errors.New("missing id column")
+	}
+	id, err := strconv.Atoi(strings.Trim(value, "` "))
+	if err != nil {
+		return 0, fmt.Errorf("invalid id %q", value)
+	}
+	return id, nil
+}
+
+// parseAttributes parses attributes formatted like formatAttributes, "key=value, ...".
+func parseAttributes(text string, attributes map[string]any) {
+	for _, pair := range strings.Split(text, ",") {
+		if key, value, ok := strings.Cut(pair, "="); ok && strings.TrimSpace(key) != "" {
+			attributes[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+}
+
+// parseDevices decodes the devices of a DeviceQuery or DeviceStatusQuery result, the Markdown
+// table the backend renders, or a JSON array as a fallback. Cells of unknown columns are kept
+// as attributes.
+func parseDevices(text string) ([]Device, error) {
+	if devices, ok, err := decodeJSON[[]Device](text); ok {
+		return devices, err
+	}
+	rows, err := parseMarkdownTables(text)
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]Device, 0, len(rows))
+	for i, row := range rows {
+		id, err := row.id()
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %w", i+1, err)
+		}
+		d := Device{ID: id, Attributes: map[string]any{}}
+		d.Name, _ = row.take(NameHeaders)
+		d.Position, _ = row.take(PositionHeaders)
+		d.Type, _ = row.take(TypeHeaders)
+		if attributes, ok := row.take(AttributesHeaders); ok {
+			parseAttributes(attributes, d.Attributes)
+		}
+		for name, value := range row {
+			if value != "" {
+				d.Attributes[name] = value
+			}
+		}
+		if len(d.Attributes) == 0 {
+			d.Attributes = nil
+		}
+		devices = append(devices, d)
+	}
+	return devices, nil
+}
+
+// parseScenes decodes the scenes of a GetScenes result, the Markdown table the backend renders,
+// or a JSON array as a fallback.
+func parseScenes(text string) ([]Scene, error) {
+	if scenes, ok, err := decodeJSON[[]Scene](text); ok {
+		return scenes, err
+	}
+	rows, err := parseMarkdownTables(text)
+	if err != nil {
+		return nil, err
+	}
+	scenes := make([]Scene, 0, len(rows))
+	for i, row := range rows {
+		id, err := row.id()
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %w", i+1, err)
+		}
+		scene := Scene{ID: id}
+		scene.Name, _ = row.take(NameHeaders)
+		scene.Position, _ = row.take(PositionHeaders)
+		scenes = append(scenes, scene)
+	}
+	return scenes, nil
+}
+
+// decodeJSON decodes text if it is a JSON document, reporting whether it is one.
+func decodeJSON[T any](text string) (value T, ok bool, err error) {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "[") && !strings.HasPrefix(text, "{") || !json.Valid([]byte(text)) {
+		return value, false, nil
+	}
+	return value, true, json.Unmarshal([]byte(text), &value)
+}
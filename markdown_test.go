@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const devicesMarkdown = `# 设备列表
+
+| endpoint_id | device_name | position_name | device_type |
+| --- | --- | --- | --- |
+| 101 | 客厅主灯 | 客厅 | light |
+| 102 | 卧室台灯 | 卧室 | light |
+`
+
+const statusMarkdown = `| ID | Name | Position | Type | on_off | brightness |
+|:--:|------|----------|------|--------|------------|
+| 101 | 客厅主灯 | 客厅 | light | on | 80 |
+| 103 | 窗帘 | 卧室 | curtain | | |
+`
+
+const scenesMarkdown = `| 场景ID | 场景名称 | 房间 |
+| --- | --- | --- |
+| 1 | 打开客厅灯 | 客厅 |
+| 2 | Movie night | Living room |
+`
+
+func TestStructuredQueriesParseMarkdown(t *testing.T) {
+	handle, calls := recordCalls(func(call upstreamCall) *http.Response {
+		switch call.Fn {
+		case "DeviceQuery":
+			return okResponse(devicesMarkdown)
+		case "DeviceStatusQuery":
+			return okResponse(statusMarkdown)
+		}
+		return okResponse(scenesMarkdown)
+	})
+	stubUpstream(t, handle)
+	ctx := context.Background()
+
+	devices, message := DeviceQueryStructured(ctx, nil, nil)
+	want := []Device{
+		{ID: 101, Name: "客厅主灯", Position: "客厅", Type: "light"},
+		{ID: 102, Name: "卧室台灯", Position: "卧室", Type: "light"},
+	}
+	if message != "" || !reflect.DeepEqual(devices, want) {
+		t.Errorf("DeviceQueryStructured = %+v %q, want %+v", devices, message, want)
+	}
+
+	statuses, message := DeviceStatusQueryStructured(ctx, nil, nil)
+	want = []Device{
+		{ID: 101, Name: "客厅主灯", Position: "客厅", Type: "light", Attributes: map[string]any{"on_off": "on", "brightness": "80"}},
+		{ID: 103, Name: "窗帘", Position: "卧室", Type: "curtain"},
+	}
+	if message != "" || !reflect.DeepEqual(statuses, want) {
+		t.Errorf("DeviceStatusQueryStructured = %+v %q, want %+v", statuses, message, want)
+	}
+
+	scenes, message := GetScenesStructured(ctx, nil)
+	wantScenes := []Scene{
+		{ID: 1, Name: "打开客厅灯", Position: "客厅"},
+		{ID: 2, Name: "Movie night", Position: "Living room"},
+	}
+	if message != "" || !reflect.DeepEqual(scenes, wantScenes) {
+		t.Errorf("GetScenesStructured = %+v %q, want %+v", scenes, message, wantScenes)
+	}
+
+	for _, call := range calls() {
+		if strings.Contains(string(call.Params), `"format"`) {
+			t.Errorf("%s asked for a format the backend does not know: %s", call.Fn, call.Params)
+		}
+	}
+}
+
+func TestParseDevices(t *testing.T) {
+	// The Markdown rendered by DevicesMarkdown reads back into the same devices.
+	devices := []Device{
+		{ID: 1, Name: "Lamp", Position: "Bedroom", Type: "light", Attributes: map[string]any{"brightness": "40", "on_off": "off"}},
+		{ID: 2, Name: "Fan", Position: "Bedroom", Type: "fan"},
+	}
+	if got, err := parseDevices(DevicesMarkdown(devices)); err != nil || !reflect.DeepEqual(got, devices) {
+		t.Errorf("parseDevices(DevicesMarkdown) = %+v %v, want %+v", got, err, devices)
+	}
+
+	decoded := `[{"endpoint_id":1,"device_name":"Lamp","position_name":"Bedroom","device_type":"light"}]`
+	if got, err := parseDevices(decoded); err != nil || len(got) != 1 || got[0].Name != "Lamp" {
+		t.Errorf("parseDevices(JSON) = %+v %v, want the JSON decoded", got, err)
+	}
+	if got, err := parseDevices(""); err != nil || len(got) != 0 {
+		t.Errorf("parseDevices(\"\") = %+v %v, want no devices", got, err)
+	}
+	for _, text := range []string{
+		"设备查询失败",
+		"| Name |\n| --- |\n| Lamp |",
+		"| ID | Name |\n| --- | --- |\n| abc | Lamp |",
+	} {
+		if got, err := parseDevices(text); err == nil {
+			t.Errorf("parseDevices(%q) = %+v, want an error", text, got)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/devfans/golang/log"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	toolCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "yalla_tool_calls_total",
+		Help: "Number of MCP tool calls by tool name and outcome.",
+	}, []string{"tool", "outcome"})
+	toolCallDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "yalla_tool_call_duration_seconds",
+		Help:    "Duration of MCP tool calls by tool name.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"tool"})
+	upstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "yalla_upstream_request_duration_seconds",
+		Help:    "Duration of upstream service calls, including retries, by service name and outcome.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"service", "outcome"})
+	inflightRequests = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "yalla_inflight_requests",
+		Help: "Number of MCP requests being handled.",
+	})
+)
+
+// outcome labels a call as "success" or "error".
+func outcome(failed bool) string {
+	if failed {
+		return "error"
+	}
+	return "success"
+}
+
+// observeToolCall records a completed MCP request if it is a tool call.
+func observeToolCall(req mcp.Request, result mcp.Result, err error, duration time.Duration) {
+	ctr, ok := req.(*mcp.CallToolRequest)
+	if !ok {
+		return
+	}
+	failed := err != nil
+	if r, ok := result.(*mcp.CallToolResult); ok && r != nil && r.IsError {
+		failed = true
+	}
+	toolCalls.WithLabelValues(ctr.Params.Name, outcome(failed)).Inc()
+	toolCallDuration.WithLabelValues(ctr.Params.Name).Observe(duration.Seconds())
+}
+
+// observeUpstream records the duration of an upstream service call.
+func observeUpstream(serviceName string, failed bool, duration time.Duration) {
+	upstreamDuration.WithLabelValues(serviceName, outcome(failed)).Observe(duration.Seconds())
+}
+
+// serveMetrics serves the metrics on a dedicated listener at METRICS_ADDR.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle(METRICS_PATH, promhttp.Handler())
+	log.Info("Metrics server will start", "url", addr, "path", METRICS_PATH)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Error("Metrics server stopped", "err", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/devfans/golang/log"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// progressReporter sends progress notifications for a tool call whose client asked for them
+// by setting a progress token.
+type progressReporter struct {
+	session  *mcp.ServerSession
+	token    any
+	mu       sync.Mutex
+	progress float64
+}
+
+type progressKey struct{}
+
+// progressMiddleware makes a progress reporter available to the upstream calls of tool calls
+// carrying a progress token.
+func progressMiddleware(next mcp.MethodHandler) mcp.MethodHandler {
+	return func(ctx context.Context, method string, req mcp.Request) (mcp.Result, error) {
+		if ctr, ok := req.(*mcp.CallToolRequest); ok {
+			if token := ctr.Params.GetProgressToken(); token != nil {
+				if ss, ok := req.GetSession().(*mcp.ServerSession); ok {
+					ctx = context.WithValue(ctx, progressKey{}, &progressReporter{session: ss, token: token})
+				}
+			}
+		}
+		return next(ctx, method, req)
+	}
+}
+
+// reportProgress notifies the client of the tool call of ctx that it is making progress,
+// if it asked for notifications. The progress grows with each report, the total is unknown.
+func reportProgress(ctx context.Context, message string) {
+	r, ok := ctx.Value(progressKey{}).(*progressReporter)
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	r.progress++
+	progress := r.progress
+	r.mu.Unlock()
+	err := r.session.NotifyProgress(ctx, &mcp.ProgressNotificationParams{
+		ProgressToken: r.token,
+		Progress:      progress,
+		Message:       message,
+	})
+	if err != nil {
+		log.Debug("Failed to send progress notification", "err", err)
+	}
+}
+
+// trackProgress reports that the upstream call to serviceName started, then that it is
+// still running every interval until the returned stop is called, so clients of slow
+// calls can tell the server has not hung. No report is sent after stop returns.
+func trackProgress(ctx context.Context, serviceName string, interval time.Duration) (stop func()) {
+	if _, ok := ctx.Value(progressKey{}).(*progressReporter); !ok {
+		return func() {}
+	}
+	reportProgress(ctx, tr("Calling %s", serviceName))
+	if interval <= 0 {
+		return func() {}
+	}
+	done, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		start := time.Now()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				reportProgress(ctx, tr("Still waiting for %s, %s elapsed", serviceName, time.Since(start).Round(time.Second)))
+			}
+		}
+	}()
+	// Wait for a report in flight, so none is sent once the call has returned.
+	return func() {
+		close(done)
+		<-exited
+	}
+}
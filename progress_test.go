@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+func TestTrackProgressStops(t *testing.T) {
+	ctx := context.Background()
+	serverTransport, clientTransport := mcp.NewInMemoryTransports()
+	ss, err := mcp.NewServer(&mcp.Implementation{Name: "test"}, nil).Connect(ctx, serverTransport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Close()
+	cs, err := mcp.NewClient(&mcp.Implementation{Name: "test"}, nil).Connect(ctx, clientTransport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	reporter := &progressReporter{session: ss, token: "token"}
+	progress := func() float64 {
+		reporter.mu.Lock()
+		defer reporter.mu.Unlock()
+		return reporter.progress
+	}
+	stop := trackProgress(context.WithValue(ctx, progressKey{}, reporter), "GetHomes", time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	stop()
+	reported := progress()
+	if reported < 2 {
+		t.Fatalf("got %v reports, want the start and periodic ones", reported)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if got := progress(); got != reported {
+		t.Errorf("got %v reports, want none after stop beyond the %v before", got, reported)
+	}
+}
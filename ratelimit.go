@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/devfans/golang/log"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// tokenBucket holds the available tokens of one session.
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// rateLimiter is a per-session token bucket limiter.
+//
+// Buckets live in a SessionRegistry: buckets idle for longer than idleTTL are evicted,
+// and at most maxSessions are kept.
+type rateLimiter struct {
+	rate    float64
+	burst   float64
+	buckets *SessionRegistry[tokenBucket]
+}
+
+func newRateLimiter(rate float64, burst int, idleTTL time.Duration, maxSessions int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: NewSessionRegistry[tokenBucket](idleTTL, maxSessions),
+	}
+}
+
+// Allow takes a token from the session's bucket and reports whether one was available.
+func (l *rateLimiter) Allow(session mcp.Session) bool {
+	allowed := false
+	l.buckets.Update(session, func(b tokenBucket, ok bool) tokenBucket {
+		now := time.Now()
+		if !ok {
+			b = tokenBucket{tokens: l.burst, lastSeen: now}
+		}
+		b.tokens = min(l.burst, b.tokens+now.Sub(b.lastSeen).Seconds()*l.rate)
+		b.lastSeen = now
+		if b.tokens >= 1 {
+			b.tokens--
+			allowed = true
+		}
+		return b
+	})
+	return allowed
+}
+
+// rateLimitMiddleware rejects tool calls of sessions exceeding the limiter's rate.
+func rateLimitMiddleware(limiter *rateLimiter) mcp.Middleware {
+	return func(next mcp.MethodHandler) mcp.MethodHandler {
+		return func(ctx context.Context, method string, req mcp.Request) (mcp.Result, error) {
+			if _, ok := req.(*mcp.CallToolRequest); ok && !limiter.Allow(req.GetSession()) {
+				log.Warn("Tool call rate limited", "method", method, "session_id", req.GetSession().ID())
+				return nil, fmt.Errorf("rate limit exceeded: at most %g tool calls per second (burst %g), please retry later", limiter.rate, limiter.burst)
+			}
+			return next(ctx, method, req)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/google/uuid"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// requestIDs is the request id of a tool invocation, shared by the upstream calls it makes.
+type requestIDs struct {
+	id    string
+	calls atomic.Int32
+}
+
+type requestIDKey struct{}
+
+// newRequestID returns a fresh request id in the format sent to the backend.
+func newRequestID() string {
+	return strings.ReplaceAll(uuid.NewString(), "-", "")
+}
+
+// withRequestID returns a context carrying id as the request id of a tool invocation.
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, &requestIDs{id: id})
+}
+
+// requestIDFromContext returns the request id of the tool invocation of ctx, or empty outside of one.
+func requestIDFromContext(ctx context.Context) string {
+	if ids, ok := ctx.Value(requestIDKey{}).(*requestIDs); ok {
+		return ids.id
+	}
+	return ""
+}
+
+// nextRequestID returns the request id of the next upstream call of the tool invocation of ctx.
+// The first call uses the invocation's id and later ones a numbered suffix, so they are
+// correlatable while still unique for the backend's dedupe. Calls outside of a tool
+// invocation get a fresh id.
+func nextRequestID(ctx context.Context) string {
+	ids, ok := ctx.Value(requestIDKey{}).(*requestIDs)
+	if !ok {
+		return newRequestID()
+	}
+	if n := ids.calls.Add(1); n > 1 {
+		return fmt.Sprintf("%s-%d", ids.id, n)
+	}
+	return ids.id
+}
+
+// CorrelationHeader carries a client's correlation id, logged with the tool calls of the
+// HTTP request and passed on to upstream requests, so one request can be traced across
+// the client, this server and the backend.
+const CorrelationHeader = "X-Request-ID"
+
+// correlationMetaKey is the _meta key a correlation id is carried in from the HTTP request
+// to the tool call, as the SSE transport hands messages over without their request.
+const correlationMetaKey = "yalla/correlation_id"
+
+type correlationIDKey struct{}
+
+// withCorrelationID returns a context carrying the client's correlation id.
+func withCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+// correlationIDFromContext returns the client's correlation id carried by ctx, or empty if none.
+func correlationIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey{}).(string)
+	return id
+}
+
+// correlationID returns the correlation id of a tool call, tagged into its _meta by
+// correlationMiddleware or sent as a header over a transport exposing them.
+func correlationID(req *mcp.CallToolRequest) string {
+	if id, ok := req.Params.Meta[correlationMetaKey].(string); ok && validCorrelationID(id) {
+		return id
+	}
+	if extra := req.GetExtra(); extra != nil && extra.Header != nil {
+		if id := extra.Header.Get(CorrelationHeader); validCorrelationID(id) {
+			return id
+		}
+	}
+	return ""
+}
+
+// validCorrelationID reports whether id is safe to log and forward: up to 128 letters,
+// digits and "-_.:" characters.
+func validCorrelationID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// tagCorrelationID sets id in the _meta of the tool calls of body, a single JSON-RPC message
+// or a batch. The body is returned unchanged if it cannot be parsed.
+func tagCorrelationID(body []byte, id string) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var message any
+	if err := decoder.Decode(&message); err != nil {
+		return body
+	}
+	messages, batch := message.([]any)
+	if !batch {
+		messages = []any{message}
+	}
+	for _, m := range messages {
+		request, ok := m.(map[string]any)
+		if !ok || request["method"] != "tools/call" {
+			continue
+		}
+		params, ok := request["params"].(map[string]any)
+		if !ok {
+			if request["params"] != nil {
+				continue
+			}
+			params = map[string]any{}
+			request["params"] = params
+		}
+		meta, ok := params["_meta"].(map[string]any)
+		if !ok {
+			if params["_meta"] != nil {
+				continue
+			}
+			meta = map[string]any{}
+			params["_meta"] = meta
+		}
+		meta[correlationMetaKey] = id
+	}
+	tagged, err := json.Marshal(message)
+	if err != nil {
+		return body
+	}
+	return tagged
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestUpstreamHeaders(t *testing.T) {
+	handle, calls := recordCalls(func(call upstreamCall) *http.Response {
+		return okResponse(nil)
+	})
+	stubUpstream(t, handle)
+	ctx := withCorrelationID(withRequestID(context.Background(), "abc123"), "client-42")
+
+	CallService[any](ctx, "GetHomes", nil)
+	CallService[any](ctx, "GetCurrentHome", nil)
+	got := calls()
+	if len(got) != 2 {
+		t.Fatalf("got %d calls, want 2", len(got))
+	}
+	header := got[0].Header
+	for name, want := range map[string]string{
+		"app_id":          HEADER_APP_ID,
+		"lang":            HEADER_LANG,
+		"app_lang":        HEADER_APP_LANG,
+		"time_zone":       HEADER_TIME_ZONE,
+		"Content-Type":    "application/json",
+		"Accept-Encoding": "gzip",
+		CorrelationHeader: "client-42",
+	} {
+		if value := header.Get(name); value == "" || value != want {
+			t.Errorf("got header %s %q, want %q", name, value, want)
+		}
+	}
+	if header.Get(SIGNATURE_HEADER_SIGNATURE) == "" {
+		t.Error("request not signed")
+	}
+	if got[0].RequestID != "abc123" || got[1].RequestID != "abc123-2" {
+		t.Errorf("got request ids %q and %q, want the tool call's id numbered", got[0].RequestID, got[1].RequestID)
+	}
+}
+
+func TestHeaderLang(t *testing.T) {
+	for _, tc := range []struct {
+		lang string
+		want string
+	}{
+		{"", "en"},
+		{"C", "en"},
+		{"POSIX", "en"},
+		{"zh_CN.UTF-8", "zh-CN"},
+		{"en_us", "en-US"},
+		{"de@euro", "de"},
+		{"ZH", "zh"},
+	} {
+		if got := headerLang(tc.lang); got != tc.want {
+			t.Errorf("headerLang(%q) = %q, want %q", tc.lang, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// cronField is a field of a crontab expression with its allowed value range.
+type cronField struct {
+	name     string
+	min, max int
+}
+
+// cronFields are the fields of the "minute hour day month weekday" crontab format
+// accepted by AutomationConfig, weekday 0 and 7 both being Sunday.
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day", 1, 31},
+	{"month", 1, 12},
+	{"weekday", 0, 7},
+}
+
+// validateSchedule checks that scheduledTime is a 5-field numeric crontab expression and
+// that it fits executionOnce: a one-time task needs a single minute and hour to run at,
+// and a periodic task on a fixed day of a fixed month would only run once a year.
+func validateSchedule(scheduledTime string, executionOnce bool) error {
+	fields := strings.Fields(scheduledTime)
+	if len(fields) != len(cronFields) {
+		return fmt.Errorf("expected 5 fields 'minute hour day month weekday', got %d", len(fields))
+	}
+	for i, field := range fields {
+		if err := validateCronField(field, cronFields[i]); err != nil {
+			return err
+		}
+	}
+	minute, hour, day, month := fields[0], fields[1], fields[2], fields[3]
+	if executionOnce && (!isSingleValue(minute) || !isSingleValue(hour)) {
+		return fmt.Errorf("a one-time task needs a single minute and hour, got '%s %s'", minute, hour)
+	}
+	if !executionOnce && isSingleValue(day) && isSingleValue(month) {
+		return fmt.Errorf("a periodic task on day %s of month %s only runs once a year, set execution_once for a one-time task", day, month)
+	}
+	return nil
+}
+
+// validateCronField checks a comma-separated list of "*", "n", "a-b", optionally followed by "/step".
+func validateCronField(field string, spec cronField) error {
+	for _, item := range strings.Split(field, ",") {
+		valueRange, step, hasStep := strings.Cut(item, "/")
+		if hasStep {
+			n, err := strconv.Atoi(step)
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid step %q in %s field", step, spec.name)
+			}
+		}
+		if valueRange == "*" {
+			continue
+		}
+		from, to, isRange := strings.Cut(valueRange, "-")
+		start, err := parseCronValue(from, spec)
+		if err != nil {
+			return err
+		}
+		if !isRange {
+			continue
+		}
+		end, err := parseCronValue(to, spec)
+		if err != nil {
+			return err
+		}
+		if start > end {
+			return fmt.Errorf("invalid range %q in %s field", valueRange, spec.name)
+		}
+	}
+	return nil
+}
+
+// parseCronValue parses a single value of a crontab field and checks its range.
+func parseCronValue(value string, spec cronField) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", spec.name, value)
+	}
+	if n < spec.min || n > spec.max {
+		return 0, fmt.Errorf("%s %d out of range %d-%d", spec.name, n, spec.min, spec.max)
+	}
+	return n, nil
+}
+
+// isSingleValue reports whether a crontab field matches exactly one value.
+func isSingleValue(field string) bool {
+	_, err := strconv.Atoi(field)
+	return err == nil
+}
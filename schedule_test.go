@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestValidateSchedule(t *testing.T) {
+	for _, tc := range []struct {
+		schedule string
+		once     bool
+		valid    bool
+	}{
+		{"0 8 * * *", false, true},
+		{"30 7 * * 1-5", false, true},
+		{"0 */2 * * 0,6", false, true},
+		{"15 9 1,15 * *", false, true},
+		{"0 22 * * 7", false, true},
+		{"0 8 25 12 *", true, true},
+		{"0 8 * * *", true, true},
+		{"0 8 25 12 *", false, false},
+		{"*/5 8 * * *", true, false},
+		{"0 8-10 * * *", true, false},
+		{"0 8 * *", false, false},
+		{"0 8 * * * *", false, false},
+		{"60 8 * * *", false, false},
+		{"0 24 * * *", false, false},
+		{"0 8 0 * *", false, false},
+		{"0 8 * 13 *", false, false},
+		{"0 8 * * 8", false, false},
+		{"0 8 * * 5-1", false, false},
+		{"0 8 * * mon", false, false},
+		{"0 */0 * * *", false, false},
+		{"0 8 * * 1,", false, false},
+	} {
+		err := validateSchedule(tc.schedule, tc.once)
+		if (err == nil) != tc.valid {
+			t.Errorf("validateSchedule(%q, once %v) = %v, want valid %v", tc.schedule, tc.once, err, tc.valid)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/google/jsonschema-go/jsonschema"
+)
+
+// constraints are validation keywords of tool argument properties, keyed by json name.
+type constraints map[string]*jsonschema.Schema
+
+// inputSchema infers the input schema of T from its json and jsonschema tags, adding the
+// validation keywords the tags cannot express. The SDK validates tool arguments against it
+// before the handler runs, so invalid input is rejected without a backend round trip.
+func inputSchema[T any](props constraints) *jsonschema.Schema {
+	schema, err := jsonschema.For[T](nil)
+	if err != nil {
+		panic(fmt.Sprintf("input schema: %v", err))
+	}
+	for name, c := range props {
+		property, ok := schema.Properties[name]
+		if !ok {
+			panic(fmt.Sprintf("input schema: no property %q", name))
+		}
+		constrain(property, c)
+	}
+	return schema
+}
+
+// constrain copies the validation keywords set in c into schema.
+func constrain(schema, c *jsonschema.Schema) {
+	if c.Minimum != nil {
+		schema.Minimum = c.Minimum
+	}
+	if c.Maximum != nil {
+		schema.Maximum = c.Maximum
+	}
+	if c.MinLength != nil {
+		schema.MinLength = c.MinLength
+	}
+	if c.Pattern != "" {
+		schema.Pattern = c.Pattern
+	}
+	if c.MinItems != nil {
+		schema.MinItems = c.MinItems
+	}
+	if c.MaxItems != nil {
+		schema.MaxItems = c.MaxItems
+	}
+	if c.MinProperties != nil {
+		schema.MinProperties = c.MinProperties
+	}
+	if c.Enum != nil {
+		schema.Enum = c.Enum
+	}
+	if c.Items != nil && schema.Items != nil {
+		constrain(schema.Items, c.Items)
+	}
+}
+
+// between returns the constraint of a number from min to max inclusive.
+func between(min, max float64) *jsonschema.Schema {
+	return &jsonschema.Schema{Minimum: jsonschema.Ptr(min), Maximum: jsonschema.Ptr(max)}
+}
+
+// oneOf returns the constraint of a string enumerated in values.
+func oneOf(values []string) *jsonschema.Schema {
+	enum := make([]any, len(values))
+	for i, v := range values {
+		enum[i] = v
+	}
+	return &jsonschema.Schema{Enum: enum}
+}
+
+// Constraints of non-empty strings, arrays and objects.
+var (
+	nonEmptyString = &jsonschema.Schema{MinLength: jsonschema.Ptr(1)}
+	nonEmptyList   = &jsonschema.Schema{MinItems: jsonschema.Ptr(1)}
+	nonEmptyObject = &jsonschema.Schema{MinProperties: jsonschema.Ptr(1)}
+)
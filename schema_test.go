@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestInputSchemaConstraints(t *testing.T) {
+	schema := set_light.InputSchema
+	if p := schema.Properties["brightness"]; p.Minimum == nil || *p.Minimum != 0 || p.Maximum == nil || *p.Maximum != 100 {
+		t.Errorf("brightness is not constrained to 0-100: %+v", p)
+	}
+	if p := schema.Properties["devices"]; p.MinItems == nil || *p.MinItems != 1 {
+		t.Errorf("devices may be empty: %+v", p)
+	}
+	rgb := schema.Properties["rgb"]
+	if rgb.MinItems == nil || *rgb.MinItems != 3 || rgb.MaxItems == nil || *rgb.MaxItems != 3 {
+		t.Errorf("rgb is not constrained to 3 items: %+v", rgb)
+	}
+	if rgb.Items == nil || rgb.Items.Maximum == nil || *rgb.Items.Maximum != 255 {
+		t.Errorf("rgb items are not constrained to 0-255: %+v", rgb.Items)
+	}
+	if p := list_scenes.InputSchema.Properties["format"]; len(p.Enum) != len(resultFormats) {
+		t.Errorf("format is not enumerated: %+v", p)
+	}
+
+	resolved, err := schema.Resolve(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		args  string
+		valid bool
+	}{
+		{`{"devices":[1],"brightness":50}`, true},
+		{`{"devices":[1],"rgb":[255,0,128]}`, true},
+		{`{"devices":[],"brightness":50}`, false},
+		{`{"devices":[1],"brightness":150}`, false},
+		{`{"devices":[1],"rgb":[255,0]}`, false},
+		{`{"devices":[1],"rgb":[255,0,256]}`, false},
+	} {
+		var args map[string]any
+		if err := json.Unmarshal([]byte(tc.args), &args); err != nil {
+			t.Fatal(err)
+		}
+		if err := resolved.Validate(args); (err == nil) != tc.valid {
+			t.Errorf("validating %s: got %v, want valid %v", tc.args, err, tc.valid)
+		}
+	}
+}
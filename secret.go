@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/devfans/golang/log"
+)
+
+// secretManager caches the app secret used to sign upstream requests.
+//
+// The secret is fetched lazily on first use, re-fetched once it is older than ttl
+// (if ttl is positive), and re-fetched after Invalidate, e.g. when the backend
+// rejects a signature. A stale secret is kept if a refresh fails.
+//
+// Concurrent Gets needing a refresh share a single fetch instead of each calling the
+// backend, and wait for it without holding the lock.
+type secretManager struct {
+	mu        sync.Mutex
+	secret    string
+	fetchedAt time.Time
+	expired   bool
+	ttl       time.Duration
+	fetch     func(ctx context.Context) (string, error)
+	inflight  *secretFetch
+}
+
+// secretFetch is a fetch of the secret in progress, done is closed once it completes.
+type secretFetch struct {
+	done chan struct{}
+}
+
+func newSecretManager(ttl time.Duration, fetch func(ctx context.Context) (string, error)) *secretManager {
+	return &secretManager{ttl: ttl, fetch: fetch}
+}
+
+// Get returns the current secret, fetching it first if missing or expired. If ctx is done
+// before the fetch completes, the stale secret is returned while the fetch goes on.
+func (m *secretManager) Get(ctx context.Context) string {
+	m.mu.Lock()
+	if m.secret != "" && !m.expired && (m.ttl <= 0 || time.Since(m.fetchedAt) < m.ttl) {
+		defer m.mu.Unlock()
+		return m.secret
+	}
+	call := m.inflight
+	if call == nil {
+		call = &secretFetch{done: make(chan struct{})}
+		m.inflight = call
+		// The fetch is shared with other callers, so it must outlive the ctx of this one.
+		go m.refresh(context.WithoutCancel(ctx), call)
+	}
+	stale := m.secret
+	m.mu.Unlock()
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return stale
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.secret
+}
+
+// refresh fetches the secret for call and stores it, keeping the stale one on failure.
+func (m *secretManager) refresh(ctx context.Context, call *secretFetch) {
+	secret, err := m.fetch(ctx)
+	m.mu.Lock()
+	if err != nil {
+		log.Error("Failed to refresh app secret", "err", err, "has_stale", m.secret != "")
+	} else {
+		m.secret, m.fetchedAt, m.expired = secret, time.Now(), false
+	}
+	m.inflight = nil
+	m.mu.Unlock()
+	close(call.done)
+}
+
+// Warmup fetches the secret, retrying up to attempts times with exponential backoff from delay.
+// It reports whether a secret was obtained; on failure later Gets keep trying lazily.
+func (m *secretManager) Warmup(ctx context.Context, attempts int, delay time.Duration) bool {
+	for i := 0; ; i++ {
+		if m.Get(ctx) != "" {
+			return true
+		}
+		if i+1 >= attempts {
+			log.Error("Failed to obtain app secret at startup, will retry on demand", "attempts", attempts)
+			return false
+		}
+		log.Warn("Retrying app secret fetch", "attempt", i+1, "delay", delay)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// Invalidate marks the current secret as expired so the next Get re-fetches it.
+func (m *secretManager) Invalidate() {
+	m.mu.Lock()
+	m.expired = true
+	m.mu.Unlock()
+}
+
+// Ready reports whether a secret has been obtained.
+func (m *secretManager) Ready() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.secret != ""
+}
+
+// fetchSecret requests the app secret for AppID from the backend.
+func fetchSecret(ctx context.Context) (string, error) {
+	url := apiURL(API_SECRET_PATH)
+	result, err := httpGet[map[string]string](ctx, url, map[string]string{"key": AppID})
+	if err != nil {
+		return "", err
+	}
+	if result == nil {
+		return "", errors.New("no secret returned from server")
+	}
+	if v, ok := (*result)["secret_key"]; ok && v != "" {
+		return v, nil
+	}
+	return "", errors.New("secret key not found in response")
+}
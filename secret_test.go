@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSecretManagerRetriesFailedFetch(t *testing.T) {
+	var fetches atomic.Int32
+	m := newSecretManager(0, func(ctx context.Context) (string, error) {
+		if fetches.Add(1) == 1 {
+			return "", errors.New("backend down")
+		}
+		return "secret", nil
+	})
+
+	if got := m.Get(context.Background()); got != "" {
+		t.Fatalf("got %q after a failed fetch, want no secret", got)
+	}
+	if m.Ready() {
+		t.Fatal("ready after a failed fetch")
+	}
+	if got := m.Get(context.Background()); got != "secret" {
+		t.Fatalf("got %q, want the secret of the second fetch", got)
+	}
+	if !m.Ready() {
+		t.Fatal("not ready after a successful fetch")
+	}
+	m.Get(context.Background())
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("got %d fetches, want 2: a fresh secret is cached", n)
+	}
+}
+
+func TestSecretManagerSharesFetch(t *testing.T) {
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	m := newSecretManager(0, func(ctx context.Context) (string, error) {
+		fetches.Add(1)
+		<-release
+		return "secret", nil
+	})
+
+	const callers = 50
+	var wg sync.WaitGroup
+	secrets := make([]string, callers)
+	for i := range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			secrets[i] = m.Get(context.Background())
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("got %d fetches for %d concurrent callers, want 1", n, callers)
+	}
+	for i, secret := range secrets {
+		if secret != "secret" {
+			t.Errorf("caller %d got %q", i, secret)
+		}
+	}
+}
+
+func TestSecretManagerKeepsStaleSecret(t *testing.T) {
+	var fetches atomic.Int32
+	m := newSecretManager(0, func(ctx context.Context) (string, error) {
+		if fetches.Add(1) == 1 {
+			return "old", nil
+		}
+		return "", errors.New("backend down")
+	})
+
+	m.Get(context.Background())
+	m.Invalidate()
+	if got := m.Get(context.Background()); got != "old" {
+		t.Errorf("got %q, want the stale secret kept when the refresh fails", got)
+	}
+}
+
+func TestSignatureRejectedRefreshesSecret(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		rejected func() *http.Response
+	}{
+		{"status", func() *http.Response { return stubResponse(http.StatusUnauthorized, "") }},
+		{"business code", func() *http.Response { return apiErrorResponse(CodeInvalidSignature, "invalid signature") }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var rejected atomic.Bool
+			handle, calls := recordCalls(func(call upstreamCall) *http.Response {
+				if rejected.CompareAndSwap(false, true) {
+					return tc.rejected()
+				}
+				return okResponse("ok")
+			})
+			stubUpstream(t, handle)
+			var fetches atomic.Int32
+			AppSecrets = newSecretManager(0, func(ctx context.Context) (string, error) {
+				if fetches.Add(1) == 1 {
+					return "old", nil
+				}
+				return "new", nil
+			})
+
+			result, err := CallService[string](context.Background(), "GetHomes", nil)
+			if err != nil || *result != "ok" {
+				t.Fatalf("got %v %v, want the call resent with the refreshed secret", result, err)
+			}
+			if n := fetches.Load(); n != 2 {
+				t.Errorf("got %d secret fetches, want 2", n)
+			}
+			if got := calls(); len(got) != 2 {
+				t.Errorf("got %d calls, want the rejected one and its resend", len(got))
+			}
+			if got := AppSecrets.Get(context.Background()); got != "new" {
+				t.Errorf("got secret %q, want the refreshed one", got)
+			}
+		})
+	}
+}
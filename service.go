@@ -5,37 +5,30 @@ import (
 	"crypto/md5"
 	"crypto/sha1"
 	"encoding/hex"
-	"fmt"
+	"math"
 	"net"
 	"os"
 	"runtime"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/devfans/envconf/dotenv"
 	"github.com/devfans/golang/log"
+	"github.com/google/jsonschema-go/jsonschema"
 	"github.com/google/uuid"
 	"github.com/modelcontextprotocol/go-sdk/mcp"
 )
 
 // Global variables
 var (
-	DeviceID = genDeviceID()
-	AppID = genAppID()
-	AppSecret = genSecret()
+	Identity = loadIdentity(IDENTITY_FILE)
+	DeviceID = Identity.DeviceID
+	AppID = Identity.AppID
+	AppSecrets = newSecretManager(SECRET_TTL, fetchSecret)
 )
 
 
-const NOTES = `
-NOTES:
-- 走廊连接着客厅，厨房，玄关，主卧，次卧和卫生间
-- 吊灯在主卧, 左灯，右灯分别在主卧床的两侧 
-- Button "客厅打开" 会打开客厅所有灯光, 次卧打开/卫生间打开/厨房打开/玄关打开/主卧打开 同理，以及对应的关闭按钮
-- 桌面是客厅的一部分，只有灯带，氛围灯也在客厅
-- 客厅灯带包含 桌面灯带和电视灯带
-- 餐桌灯在桌面旁边，但餐桌在走廊，吃饭时需要走廊灯和厨房灯但不需要餐桌灯
-`
-
 const (
 	Version                         = "0.0.3"
 	RequestSignatureHeaderAccessKey = "X-Access-Key"
@@ -48,61 +41,199 @@ const (
 
 var (
 	API_BASE_URL = "https://ai-echo.aqara.cn/echo/mcp"
+	API_CALL_PATH = dotenv.String("API_CALL_PATH", "/call")
+	API_SECRET_PATH = dotenv.String("API_SECRET_PATH", "/secret")
+	NOTES_FILE = dotenv.String("NOTES_FILE")
+	DEVICE_ID = dotenv.String("DEVICE_ID")
+	IDENTITY_FILE = dotenv.String("IDENTITY_FILE", defaultIdentityFile())
+	LANG = dotenv.String("LANG", "en")
+	LOG_LEVEL = dotenv.String("LOG_LEVEL", "INFO")
+	LISTEN_SOCKET = dotenv.String("LISTEN_SOCKET")
+	TLS_CERT_FILE = dotenv.String("TLS_CERT_FILE")
+	TLS_KEY_FILE = dotenv.String("TLS_KEY_FILE")
+	TLS_MIN_VERSION = dotenv.String("TLS_MIN_VERSION", "1.2")
+	METRICS_ADDR = dotenv.String("METRICS_ADDR")
+	METRICS_PATH = dotenv.String("METRICS_PATH", "/metrics")
+	OTEL_EXPORTER_OTLP_ENDPOINT = dotenv.String("OTEL_EXPORTER_OTLP_ENDPOINT")
 	API_KEY = dotenv.String("API_KEY")
 	API_TOKEN = dotenv.String("API_TOKEN")
+	LOGIN_USERNAME = dotenv.String("LOGIN_USERNAME")
+	LOGIN_PASSWORD = dotenv.String("LOGIN_PASSWORD")
+	LOGIN_REGION = dotenv.String("LOGIN_REGION", "CN")
+	DEFAULT_REGION = strings.ToUpper(strings.TrimSpace(dotenv.String("DEFAULT_REGION")))
+	API_TIMEOUT = durationEnv("API_TIMEOUT", DefaultAPITimeout)
+	API_DIAL_TIMEOUT = durationEnv("API_DIAL_TIMEOUT", 5*time.Second)
+	API_TLS_HANDSHAKE_TIMEOUT = durationEnv("API_TLS_HANDSHAKE_TIMEOUT", 5*time.Second)
+	API_RESPONSE_HEADER_TIMEOUT = durationEnv("API_RESPONSE_HEADER_TIMEOUT", DefaultAPITimeout)
+	API_MAX_IDLE_CONNS_PER_HOST = dotenv.Int("API_MAX_IDLE_CONNS_PER_HOST", 16)
+	API_PROXY = dotenv.String("API_PROXY")
+	USER_AGENT = dotenv.String("USER_AGENT", "yalla-mcp/"+Version)
+	HEADER_LANG = dotenv.String("HEADER_LANG", headerLang(LANG))
+	HEADER_APP_LANG = dotenv.String("HEADER_APP_LANG", HEADER_LANG)
+	HEADER_APP_ID = dotenv.String("HEADER_APP_ID", AppID)
+	HEADER_TIME_ZONE = dotenv.String("HEADER_TIME_ZONE", localTimeZone())
+	HOME_TIME_ZONE = dotenv.String("HOME_TIME_ZONE", HEADER_TIME_ZONE)
+	API_MAX_CONCURRENCY = dotenv.Int("API_MAX_CONCURRENCY", 8)
+	API_RETRIES = dotenv.Int("API_RETRIES", 3)
+	API_RETRY_DELAY = durationEnv("API_RETRY_DELAY", 500*time.Millisecond)
+	API_RETRY_MAX_WAIT = durationEnv("API_RETRY_MAX_WAIT", 30*time.Second)
+	RETRY_CODES = parseRetryCodes(dotenv.String("RETRY_CODES"))
+	CIRCUIT_BREAKER_THRESHOLD = dotenv.Int("CIRCUIT_BREAKER_THRESHOLD", 5)
+	CIRCUIT_BREAKER_COOLDOWN = durationEnv("CIRCUIT_BREAKER_COOLDOWN", 30*time.Second)
+	PROGRESS_INTERVAL = durationEnv("PROGRESS_INTERVAL", 5*time.Second)
+	CONTROL_VERIFY_RETRIES = dotenv.Int("CONTROL_VERIFY_RETRIES", 2)
+	CONTROL_VALIDATE_SLOTS = dotenv.Bool("CONTROL_VALIDATE_SLOTS", false)
+	CONTROL_MAX_BATCH = dotenv.Int("CONTROL_MAX_BATCH", 50)
+	CONTROL_BATCH_MODE = dotenv.String("CONTROL_BATCH_MODE", "chunk")
+	CONTROL_VERIFY_DELAY = durationEnv("CONTROL_VERIFY_DELAY", time.Second)
+	SIGNATURE_HEADER_ACCESS_KEY = dotenv.String("SIGNATURE_HEADER_ACCESS_KEY", RequestSignatureHeaderAccessKey)
+	SIGNATURE_HEADER_SIGNATURE = dotenv.String("SIGNATURE_HEADER_SIGNATURE", RequestSignatureHeaderSignature)
+	SIGNATURE_HEADER_TIMESTAMP = dotenv.String("SIGNATURE_HEADER_TIMESTAMP", RequestSignatureHeaderTimestamp)
+	SIGNATURE_HEADER_NONCE = dotenv.String("SIGNATURE_HEADER_NONCE", RequestSignatureHeaderNonce)
+	SIGNATURE_NONCE_LENGTH = dotenv.Int("SIGNATURE_NONCE_LENGTH", 16)
+	RATE_LIMIT_RPS = dotenv.Float("RATE_LIMIT_RPS", 0)
+	RATE_LIMIT_BURST = dotenv.Int("RATE_LIMIT_BURST", 10)
+	RATE_LIMIT_IDLE_TTL = durationEnv("RATE_LIMIT_IDLE_TTL", 10*time.Minute)
+	SECRET_TTL = durationEnv("SECRET_TTL", 0)
+	SECRET_RETRIES = dotenv.Int("SECRET_RETRIES", 5)
+	SECRET_RETRY_DELAY = durationEnv("SECRET_RETRY_DELAY", time.Second)
+	DEFAULT_HOME = dotenv.String("DEFAULT_HOME")
+	DEFAULT_POSITIONS = parseList(dotenv.String("DEFAULT_POSITIONS"))
+	DEFAULT_DEVICE_TYPES = parseList(dotenv.String("DEFAULT_DEVICE_TYPES"))
+	DEFAULT_HOME_REGION = dotenv.String("DEFAULT_HOME_REGION")
+	DEFAULT_HOME_RETRIES = dotenv.Int("DEFAULT_HOME_RETRIES", 3)
+	DEFAULT_HOME_RETRY_DELAY = durationEnv("DEFAULT_HOME_RETRY_DELAY", time.Second)
+	SESSION_IDLE_TTL = durationEnv("SESSION_IDLE_TTL", 24*time.Hour)
+	FUZZY_MATCH_THRESHOLD = dotenv.Float("FUZZY_MATCH_THRESHOLD", 0.6)
+	DRY_RUN = dotenv.Bool("DRY_RUN", false)
+	READ_ONLY = dotenv.Bool("READ_ONLY", false)
+	QUERY_CACHE_TTL = durationEnv("QUERY_CACHE_TTL", 30*time.Second)
+	ENABLE_RAW_CALL = dotenv.Bool("ENABLE_RAW_CALL", false)
+	ENABLED_TOOLS = parseList(dotenv.String("ENABLED_TOOLS"))
+	DISABLED_TOOLS = parseList(dotenv.String("DISABLED_TOOLS"))
+	MAX_RESULT_BYTES = dotenv.Int("MAX_RESULT_BYTES", 64*1024)
 )
 
-func genSecret() string {
-	url := API_BASE_URL + "/secret"
-	result, err := httpGet[map[string]string](url, map[string]string{"key": AppID})
+// durationEnv parses a duration string (e.g. "500ms", "2s") from env, falling back to the default if unset or invalid.
+func durationEnv(name string, fallback time.Duration) time.Duration {
+	value := dotenv.String(name)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
 	if err != nil {
-		log.Error("Failed to generate secret", "err", err)
-		return ""
+		log.Error("Invalid duration setting, using default", "name", name, "value", value, "default", fallback, "err", err)
+		return fallback
 	}
-	if result == nil {
-		log.Warn("No secret returned from server")
+	return d
+}
+
+// loadNotes reads the home description notes appended to the control buttons tool description.
+func loadNotes(path string) string {
+	if path == "" {
 		return ""
 	}
-	if v, ok := (*result)["secret_key"]; ok {
-		return v
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Error("Failed to read notes file", "path", path, "err", err)
+		return ""
 	}
-	log.Warn("Secret key not found in response")
-	return ""
+	return strings.TrimSpace(string(data))
 }
 
-// genDeviceID generates a unique device identifier.
+// genDeviceID returns DEVICE_ID when set, otherwise generates a device identifier from the host.
+//
+// The prefix tells how stable the identifier is: "mcp0." ids are derived from the host
+// (its MAC address, or its machine id inside containers) and survive restarts, while
+// "mcp1." ids are random since no host identity was found and change on every start.
 func genDeviceID() string {
-	var macAddr string
-	interfaces, err := net.Interfaces()
-	if err == nil {
-		for _, i := range interfaces {
-			if i.Flags&net.FlagUp != 0 && !strings.HasPrefix(i.Name, "lo") && len(i.HardwareAddr) > 0 {
-				macAddr = i.HardwareAddr.String()
-				break
-			}
-		}
+	if DEVICE_ID != "" {
+		return DEVICE_ID
+	}
+
+	var hostID string
+	if inContainer() {
+		// The MAC of a container changes with every deploy, prefer a mounted machine id.
+		hostID = readMachineID()
+	}
+	if hostID == "" {
+		hostID = macAddress()
 	}
 
 	prefix := "mcp0."
-	if macAddr == "" {
-		macAddr = uuid.NewString()
+	if hostID == "" {
+		hostID = uuid.NewString()
 		prefix = "mcp1."
 	}
 
 	hostname, _ := os.Hostname()
 	osInfo := runtime.GOOS + "-" + runtime.GOARCH
 
-	baseInfo := strings.Join([]string{macAddr, hostname, osInfo}, "-")
+	baseInfo := strings.Join([]string{hostID, hostname, osInfo}, "-")
 	hash := sha1.New()
 	hash.Write([]byte(baseInfo))
 
 	return prefix + hex.EncodeToString(hash.Sum(nil))
 }
 
-// genAppID generates an application identifier.
-func genAppID() string {
+// macAddress returns the MAC address of the first non-loopback interface that is up.
+func macAddress() string {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	for _, i := range interfaces {
+		if i.Flags&net.FlagUp != 0 && !strings.HasPrefix(i.Name, "lo") && len(i.HardwareAddr) > 0 {
+			return i.HardwareAddr.String()
+		}
+	}
+	return ""
+}
+
+// inContainer reports whether the process appears to run inside a Docker or Podman container.
+func inContainer() bool {
+	for _, path := range []string{"/.dockerenv", "/run/.containerenv"} {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return os.Getenv("container") != ""
+}
+
+// readMachineID returns the systemd machine id, or empty if none is available.
+func readMachineID() string {
+	for _, path := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+		if data, err := os.ReadFile(path); err == nil {
+			if id := strings.TrimSpace(string(data)); id != "" {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+// localTimeZone returns the IANA name of the server's time zone, taken from TZ or the
+// /etc/localtime link, falling back to UTC when it cannot be told.
+func localTimeZone() string {
+	if tz := strings.TrimPrefix(os.Getenv("TZ"), ":"); tz != "" {
+		if _, err := time.LoadLocation(tz); err == nil {
+			return tz
+		}
+	}
+	if target, err := os.Readlink("/etc/localtime"); err == nil {
+		if _, name, ok := strings.Cut(target, "zoneinfo/"); ok && name != "" {
+			return name
+		}
+	}
+	if name := time.Local.String(); name != "Local" {
+		return name
+	}
+	return "UTC"
+}
+
+func genAppID(deviceID string) string {
 	prefix := "mcp-"
-	return prefix + md5Hash(prefix+DeviceID)
+	return prefix + md5Hash(prefix+deviceID)
 }
 
 func md5Hash(str string) string {
@@ -127,60 +258,100 @@ Comma-separated list of home names; returns an empty string or specific message
 
 func HandleListHome(ctx context.Context, req *mcp.CallToolRequest, args struct{}) (*mcp.CallToolResult, any, error) {
 	log.Info("GetHomesHandler request", "args", args)
-	homes, message := GetHomes()
+	homes, message := GetHomes(ctx)
 	if message != "" {
 		log.Error("GetHomes failed", "message", message)
-		return simpleResult(message), nil, nil
+		return errorResult(message), nil, nil
 	}
 	log.Info("Home list retrieved", "homes", homes)
 	if len(homes) == 0 {
-		return simpleResult("No homes found."), nil, nil
+		return simpleResult(tr("No homes found.")), nil, nil
 	}
 	return simpleResult(homes...), nil, nil
 }
 
 type args struct {
-	Name string `json:"name" jsonschema:"the person to greet"`
+	Name   string `json:"name" jsonschema:"the home name to switch to"`
+	Region string `json:"region,omitempty" jsonschema:"optional region of the home, e.g. CN, US, EU"`
+}
+
+var get_current_home = &mcp.Tool{
+	Name:        "get_current_home",
+	Description: `Get the user's current home, the one device and scene tools act on (useful to confirm the home before controlling devices).
+Returns:
+  Name of the current home.`,
+}
+
+// HandleGetCurrentHome handles querying the active home.
+func HandleGetCurrentHome(ctx context.Context, req *mcp.CallToolRequest, args struct{}) (*mcp.CallToolResult, any, error) {
+	log.Info("HandleGetCurrentHome request")
+	home, message := GetCurrentHome(ctx)
+	if message != "" {
+		log.Error("GetCurrentHome failed", "message", message)
+		return errorResult(message), nil, nil
+	}
+	log.Info("Current home retrieved", "home", home)
+	return simpleResult(tr("Current home: %s", home)), nil, nil
 }
 
 var switch_home = &mcp.Tool{
 	Name:        "switch_home",
-	Description: `Switch the user's current home.
+	Description: `Switch the user's current home. This changes the home for every client of the account, use get_current_home to only check it.
 Returns:
 Switch result message.
 `,
+	InputSchema: inputSchema[args](constraints{
+		"name": nonEmptyString,
+	}),
 }
 
 func HandleSwitchHome(ctx context.Context, req *mcp.CallToolRequest, args args) (*mcp.CallToolResult, any, error) {
 	log.Info("SwitchHomeHandler request", "args", args)
-	log.Info("Switching home", "homeName", args.Name)
-	success, message := SwitchHome(args.Name)
+	// Best effort, the previous home only makes the result clearer.
+	previous, _ := GetCurrentHome(ctx)
+	log.Info("Switching home", "homeName", args.Name, "region", args.Region, "previous", previous)
+	success, message := SwitchHome(ctx, args.Name, args.Region)
 	if !success {
 		log.Error("Home switch failed", "message", message)
 		// Ensure a message is always returned on failure.
 		if message == "" {
-			message = "Home switch failed due to an unknown error."
+			message = tr("Home switch failed due to an unknown error.")
 		}
-		return simpleResult(message), nil, nil
+		return errorResult(message), nil, nil
 	}
-	log.Info("Switched to home", "homeName", args.Name)
-	return simpleResult(fmt.Sprintf("Successfully switched to home \"%s\"", args.Name)), nil, nil
+	log.Info("Switched to home", "homeName", args.Name, "previous", previous)
+	result := tr("Successfully switched to home \"%s\"", args.Name)
+	if previous != "" && previous != args.Name {
+		result = tr("Switched from home \"%s\" to \"%s\"", previous, args.Name)
+	}
+	return simpleResult(result, tr("This applies to all clients of the account")), nil, nil
 }
 
 var list_scenes = &mcp.Tool{
 	Name:        "list_device_control_buttons",
 	Description: `Get all device control buttons under the user's home.
 Returns:
-  Control buttons information in Markdown format` + NOTES,
+  Control buttons information in Markdown format, or JSON if requested`,
+	InputSchema: inputSchema[argFormat](constraints{
+		"format": oneOf(resultFormats),
+	}),
+}
+type argFormat struct {
+	Format string `json:"format,omitempty" jsonschema:"optional result format, markdown (default) or json"`
 }
-
 // GetScenesHandler handles querying available scenes.
-func HandleListScenesHandler(ctx context.Context, req *mcp.CallToolRequest, args struct{}) (*mcp.CallToolResult, any, error) {
+//
+// Along with the Markdown text, the buttons are returned as structured content.
+func HandleListScenesHandler(ctx context.Context, req *mcp.CallToolRequest, args argFormat) (*mcp.CallToolResult, *ScenesOutput, error) {
 	log.Info("GetScenesHandler request", "args", req.Params.Arguments)
-	result := GetScenes([]string{})
-	result = strings.ReplaceAll(result, "scene", "device button")
-	log.Info("GetScenes result", "result", result)
-	return simpleResult(result), nil, nil
+	text, err := queryScenes(ctx, nil)
+	if err != nil {
+		log.Error("GetScenes failed", "err", err)
+		return errorResult(err.Error()), &ScenesOutput{Scenes: []Scene{}}, nil
+	}
+	result, scenes := queryResult("GetScenes", args.Format, text, tr("No scenes available"), parseScenes)
+	log.Info("GetScenes result", "scenes", len(scenes))
+	return result, &ScenesOutput{Scenes: scenes}, nil
 }
 
 var run_scenes = &mcp.Tool{
@@ -188,24 +359,811 @@ var run_scenes = &mcp.Tool{
 	Description: `Push device control buttons under the user's home, or control buttons in a specified room.
 Returns:
   Device control button push result message.`,
+	InputSchema: inputSchema[argScenes](constraints{
+		"buttons": {Items: between(1, math.MaxInt32)},
+	}),
 }
 type argScenes struct {
-	Button int `json:"button" jsonschema:"the control button to push, exactly one button should be provided"`
+	Buttons []int  `json:"buttons,omitempty" jsonschema:"the control buttons to push together, at least one button should be provided unless room is set"`
+	Button  int    `json:"button,omitempty" jsonschema:"deprecated, use buttons instead: a single control button to push"`
+	Room    string `json:"room,omitempty" jsonschema:"optional room (position) name, pushes the buttons of this room matching filter instead of the given buttons"`
+	Filter  string `json:"filter,omitempty" jsonschema:"optional text the button names in the room must contain, e.g. 打开 or 关闭"`
 }
 // GetScenesHandler handles querying available scenes.
 func HandleRunScenesHandler(ctx context.Context, req *mcp.CallToolRequest, args argScenes) (*mcp.CallToolResult, any, error) {
 	log.Info("HandleRunScenesHandler request", "args", args)
-	log.Info("Running scene", "button", args.Button)
-	result := RunScenes([]int{args.Button})
+	if strings.TrimSpace(args.Room) != "" {
+		return runRoomScenes(ctx, strings.TrimSpace(args.Room), strings.TrimSpace(args.Filter))
+	}
+	buttons := args.Buttons
+	if args.Button != 0 {
+		buttons = append(buttons, args.Button)
+	}
+	buttons = dedupe(buttons)
+	if len(buttons) == 0 {
+		return errorResult(tr("At least one button should be provided")), nil, nil
+	}
+	log.Info("Running scenes", "buttons", buttons)
+	result := RunScenes(ctx, buttons)
 	log.Info("RunScene result", "result", result)
 	return simpleResult(result), nil, nil
 }
 
+// dedupe returns the values with duplicates removed, keeping the first occurrence order.
+func dedupe(values []int) []int {
+	seen := make(map[int]bool, len(values))
+	result := make([]int, 0, len(values))
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+var run_scene_by_name = &mcp.Tool{
+	Name:        "run_scene_by_name",
+	Description: `Push a device control button under the user's home by its name, e.g. "movie night", without knowing its id.
+Returns:
+  Device control button push result message, or the candidate buttons if the name is ambiguous.`,
+	InputSchema: inputSchema[argSceneByName](constraints{
+		"name": nonEmptyString,
+	}),
+}
+type argSceneByName struct {
+	Name string `json:"name" jsonschema:"the control button name"`
+	Room string `json:"room,omitempty" jsonschema:"optional room (position) name the button is in, to tell apart buttons with the same name"`
+}
+// HandleRunSceneByName handles pushing a scene looked up by name.
+func HandleRunSceneByName(ctx context.Context, req *mcp.CallToolRequest, args argSceneByName) (*mcp.CallToolResult, any, error) {
+	log.Info("HandleRunSceneByName request", "args", args)
+	matched, suggestions, message := FindScenesByName(ctx, args.Name, strings.TrimSpace(args.Room))
+	if message != "" {
+		log.Error("FindScenesByName failed", "message", message)
+		return errorResult(message), nil, nil
+	}
+	switch len(matched) {
+	case 0:
+		if len(suggestions) > 0 {
+			return errorResult(tr("No button named %q found, did you mean: %s", args.Name, strings.Join(suggestions, ", "))), nil, nil
+		}
+		return errorResult(tr("No button named %q found", args.Name)), nil, nil
+	case 1:
+	default:
+		return simpleResult(tr("Multiple buttons named %q, pick one by id:", args.Name), ScenesMarkdown(matched)), nil, nil
+	}
+	log.Info("Running scene by name", "name", args.Name, "button", matched[0].ID)
+	result := RunScenes(ctx, []int{matched[0].ID})
+	log.Info("RunScene result", "result", result)
+	return simpleResult(result), nil, nil
+}
+
+var get_device = &mcp.Tool{
+	Name:        "get_device",
+	Description: `Get the current status of a single device under the user's home by its name, e.g. to tell whether the bedroom lamp is on.
+Returns:
+  Device status information in Markdown format or JSON if requested, or the candidate devices if the name is ambiguous.`,
+	InputSchema: inputSchema[argGetDevice](constraints{
+		"name":   nonEmptyString,
+		"format": oneOf(resultFormats),
+	}),
+}
+type argGetDevice struct {
+	Name   string `json:"name" jsonschema:"the device name"`
+	Format string `json:"format,omitempty" jsonschema:"optional result format, markdown (default) or json"`
+}
+// HandleGetDevice handles querying the status of a device by name.
+func HandleGetDevice(ctx context.Context, req *mcp.CallToolRequest, args argGetDevice) (*mcp.CallToolResult, any, error) {
+	log.Info("HandleGetDevice request", "args", args)
+	matched, suggestions, message := FindDevicesByName(ctx, args.Name)
+	if message != "" {
+		log.Error("DeviceQuery failed", "message", message)
+		return errorResult(message), nil, nil
+	}
+	switch len(matched) {
+	case 0:
+		if len(suggestions) > 0 {
+			return errorResult(tr("No device named %q found, did you mean: %s", args.Name, strings.Join(suggestions, ", "))), nil, nil
+		}
+		return errorResult(tr("No device named %q found", args.Name)), nil, nil
+	case 1:
+	default:
+		return simpleResult(tr("Multiple devices named %q, pick one by id:", args.Name), resultText(args.Format, matched, DevicesMarkdown(matched))), nil, nil
+	}
+	device, message := DeviceStatus(ctx, matched[0])
+	if message != "" {
+		log.Error("DeviceStatusQuery failed", "device", matched[0].ID, "message", message)
+		return errorResult(message), nil, nil
+	}
+	log.Info("Device status retrieved", "device", device.ID)
+	// A single device is listed like several, so the JSON is an array either way.
+	devices := []Device{*device}
+	return simpleResult(resultText(args.Format, devices, DevicesMarkdown(devices))), nil, nil
+}
+
+var home_snapshot = &mcp.Tool{
+	Name:        "home_snapshot",
+	Description: `Get all devices under the user's home together with their current status in one call, e.g. to tell the state of the home.
+Returns:
+  Devices and their status in Markdown format, or JSON if requested.`,
+	InputSchema: inputSchema[argFormat](constraints{
+		"format": oneOf(resultFormats),
+	}),
+}
+
+// HandleHomeSnapshot handles querying all devices along with their status.
+func HandleHomeSnapshot(ctx context.Context, req *mcp.CallToolRequest, args argFormat) (*mcp.CallToolResult, any, error) {
+	log.Info("HandleHomeSnapshot request")
+	devices, warning, message := HomeSnapshot(ctx)
+	if message != "" {
+		log.Error("HomeSnapshot failed", "message", message)
+		return errorResult(message), nil, nil
+	}
+	log.Info("Home snapshot retrieved", "devices", len(devices), "warning", warning)
+	text := resultText(args.Format, orEmpty(devices), DevicesMarkdown(devices))
+	if warning != "" {
+		return simpleResult(warning, text), nil, nil
+	}
+	return simpleResult(text), nil, nil
+}
+
+// runRoomScenes pushes the buttons of a room whose names contain filter.
+// Without a filter, a room with several buttons returns the candidates instead of pushing all of them.
+func runRoomScenes(ctx context.Context, room, filter string) (*mcp.CallToolResult, any, error) {
+	scenes, message := GetScenesStructured(ctx, nil)
+	if message != "" {
+		log.Error("GetScenes failed", "room", room, "message", message)
+		return errorResult(message), nil, nil
+	}
+	positions := make([]string, len(scenes))
+	for i, scene := range scenes {
+		positions[i] = scene.Position
+	}
+	resolved, suggestions := ResolveRoom(room, positions)
+	if resolved == "" {
+		if len(suggestions) > 0 {
+			return errorResult(tr("No room named %q found, did you mean: %s", room, strings.Join(suggestions, ", "))), nil, nil
+		}
+		return errorResult(tr("No room named %q found", room)), nil, nil
+	}
+	room = resolved
+	var matched []Scene
+	for _, scene := range scenes {
+		if scene.Position == room && strings.Contains(scene.Name, filter) {
+			matched = append(matched, scene)
+		}
+	}
+	if len(matched) == 0 {
+		return errorResult(tr("No buttons found in room %q matching %q", room, filter)), nil, nil
+	}
+	if filter == "" && len(matched) > 1 {
+		return simpleResult(tr("Multiple buttons in room %q, set a filter:", room) + "\n" + ScenesMarkdown(matched)), nil, nil
+	}
+	buttons := make([]int, len(matched))
+	for i, scene := range matched {
+		buttons[i] = scene.ID
+	}
+	log.Info("Running room scenes", "room", room, "filter", filter, "buttons", buttons)
+	result := RunScenes(ctx, buttons)
+	log.Info("RunScene result", "result", result)
+	return simpleResult(result), nil, nil
+}
+
+var control_device = &mcp.Tool{
+	Name:        "control_device",
+	Description: `Control devices under the user's home directly, e.g. set on/off, brightness or color.
+Returns:
+  Device control result message.`,
+	InputSchema: inputSchema[argDeviceControl](constraints{
+		"devices": nonEmptyList,
+		"slots":   nonEmptyObject,
+	}),
+}
+type argDeviceControl struct {
+	Devices        []deviceID     `json:"devices" jsonschema:"the device ids to control"`
+	Slots          map[string]any `json:"slots" jsonschema:"the control parameters to apply, keyed by attribute name, e.g. {\"on_off\": \"on\", \"brightness\": 80}"`
+	IdempotencyKey string         `json:"idempotency_key,omitempty" jsonschema:"optional unique key for this command, reuse the same key when retrying so it is executed only once"`
+	Verify         bool           `json:"verify,omitempty" jsonschema:"optional true to query the devices again after the control and report their new state, at the cost of an extra round-trip"`
+}
+// HandleDeviceControl handles controlling devices with raw slots.
+func HandleDeviceControl(ctx context.Context, req *mcp.CallToolRequest, args argDeviceControl) (*mcp.CallToolResult, any, error) {
+	log.Info("HandleDeviceControl request", "args", args)
+	if len(args.Devices) == 0 {
+		return errorResult(tr("Device list cannot be empty")), nil, nil
+	}
+	if len(args.Slots) == 0 {
+		return errorResult(tr("Control parameters cannot be empty")), nil, nil
+	}
+	if message := validateSlots(ctx, deviceIDs(args.Devices), args.Slots); message != "" {
+		return errorResult(message), nil, nil
+	}
+	result := DeviceControl(ctx, deviceIDs(args.Devices), args.Slots, args.IdempotencyKey)
+	log.Info("DeviceControl result", "result", result)
+	return controlResult(ctx, result, args.Verify, deviceIDs(args.Devices), args.Slots), nil, nil
+}
+
+var set_light = &mcp.Tool{
+	Name:        "set_light",
+	Description: `Set the lights under the user's home: on/off, brightness, color temperature or color.
+Returns:
+  Device control result message.`,
+	InputSchema: inputSchema[argSetLight](constraints{
+		"devices":    nonEmptyList,
+		"brightness": between(0, 100),
+		"color_temp": between(MinColorTempKelvin, MaxColorTempKelvin),
+		"rgb":        {MinItems: jsonschema.Ptr(3), MaxItems: jsonschema.Ptr(3), Items: between(0, 255)},
+	}),
+}
+type argSetLight struct {
+	Devices    []deviceID `json:"devices" jsonschema:"the light device ids to set"`
+	On         *bool      `json:"on,omitempty" jsonschema:"optional true to turn the lights on, false to turn them off"`
+	Brightness *int       `json:"brightness,omitempty" jsonschema:"optional brightness in percent, from 0 to 100"`
+	ColorTemp  *int       `json:"color_temp,omitempty" jsonschema:"optional color temperature in kelvin, from 2700 (warm) to 6500 (cold)"`
+	RGB        []int      `json:"rgb,omitempty" jsonschema:"optional color as [red, green, blue], each from 0 to 255"`
+	Verify     bool       `json:"verify,omitempty" jsonschema:"optional true to query the lights again after setting them and report their new state, at the cost of an extra round-trip"`
+}
+// HandleSetLight handles setting lights with typed parameters, built into slots for DeviceControl.
+func HandleSetLight(ctx context.Context, req *mcp.CallToolRequest, args argSetLight) (*mcp.CallToolResult, any, error) {
+	log.Info("HandleSetLight request", "args", args)
+	if len(args.Devices) == 0 {
+		return errorResult(tr("Device list cannot be empty")), nil, nil
+	}
+	var slots []map[string]any
+	if args.On != nil {
+		slots = append(slots, OnOffSlot(*args.On))
+	}
+	if args.Brightness != nil {
+		slot, err := BrightnessSlot(*args.Brightness)
+		if err != nil {
+			return errorResult(err.Error()), nil, nil
+		}
+		slots = append(slots, slot)
+	}
+	if args.ColorTemp != nil {
+		slot, err := ColorTempSlot(*args.ColorTemp)
+		if err != nil {
+			return errorResult(err.Error()), nil, nil
+		}
+		slots = append(slots, slot)
+	}
+	if args.RGB != nil {
+		if len(args.RGB) != 3 {
+			return errorResult(tr("rgb needs 3 values, got %d", len(args.RGB))), nil, nil
+		}
+		for _, v := range args.RGB {
+			if v < 0 || v > 255 {
+				return errorResult(tr("rgb value %d out of range 0-255", v)), nil, nil
+			}
+		}
+		slots = append(slots, RGBSlot(uint8(args.RGB[0]), uint8(args.RGB[1]), uint8(args.RGB[2])))
+	}
+	if len(slots) == 0 {
+		return errorResult(tr("Control parameters cannot be empty")), nil, nil
+	}
+	merged := mergeSlots(slots...)
+	if message := validateSlots(ctx, deviceIDs(args.Devices), merged); message != "" {
+		return errorResult(message), nil, nil
+	}
+	result := DeviceControl(ctx, deviceIDs(args.Devices), merged, "")
+	log.Info("DeviceControl result", "result", result)
+	return controlResult(ctx, result, args.Verify, deviceIDs(args.Devices), merged), nil, nil
+}
+
+// validateSlots checks slots against the attributes of the devices if CONTROL_VALIDATE_SLOTS
+// is set, since a key the backend does not know is silently ignored. It costs a device query.
+func validateSlots(ctx context.Context, devices []int, slots map[string]any) string {
+	if !CONTROL_VALIDATE_SLOTS {
+		return ""
+	}
+	message := ValidateSlots(ctx, devices, slots)
+	if message != "" {
+		log.Warn("Invalid control parameters", "devices", devices, "message", message)
+	}
+	return message
+}
+
+// controlResult returns the result of a DeviceControl call, followed by the new state of the
+// devices if verify is set and the control succeeded.
+func controlResult(ctx context.Context, result string, verify bool, devices []int, slots map[string]any) *mcp.CallToolResult {
+	if !verify || result != tr("Device control success") {
+		return simpleResult(result)
+	}
+	state := VerifyDeviceState(ctx, devices, slots)
+	log.Info("Device state after control", "devices", devices, "state", state)
+	return simpleResult(result, state)
+}
+
+var toggle_device = &mcp.Tool{
+	Name:        "toggle_device",
+	Description: `Toggle devices under the user's home: turn the ones that are on off and the ones that are off on, e.g. "toggle the bedroom light".
+Returns:
+  The devices turned on and off, and those without an on/off state.`,
+	InputSchema: inputSchema[argToggleDevice](constraints{
+		"devices": nonEmptyList,
+	}),
+}
+type argToggleDevice struct {
+	Devices []deviceID `json:"devices" jsonschema:"the device ids to toggle"`
+}
+// HandleToggleDevice handles flipping the on/off state of devices.
+func HandleToggleDevice(ctx context.Context, req *mcp.CallToolRequest, args argToggleDevice) (*mcp.CallToolResult, any, error) {
+	log.Info("HandleToggleDevice request", "args", args)
+	result, toggled := ToggleDevices(ctx, deviceIDs(args.Devices))
+	log.Info("ToggleDevices result", "result", result, "toggled", toggled)
+	// A dry run toggles nothing, but is not a failure.
+	if !toggled && !DRY_RUN {
+		return errorResult(result), nil, nil
+	}
+	return simpleResult(result), nil, nil
+}
+
+var dim_device = &mcp.Tool{
+	Name:        "dim_device",
+	Description: `Change the brightness of lights under the user's home relative to their current brightness, e.g. "+10%" to brighten or "-20%" to dim.
+Returns:
+  The new brightness of each device, and the devices without a brightness.`,
+	InputSchema: inputSchema[argDimDevice](constraints{
+		"devices": nonEmptyList,
+		"change":  {Pattern: `^ *[+-] *\d{1,3} *%? *$`},
+	}),
+}
+type argDimDevice struct {
+	Devices []deviceID `json:"devices" jsonschema:"the light device ids to adjust"`
+	Change  string     `json:"change" jsonschema:"the signed brightness change in percent, e.g. +10% or -20%, the result is clamped to 0-100"`
+}
+// HandleDimDevice handles relative brightness changes.
+func HandleDimDevice(ctx context.Context, req *mcp.CallToolRequest, args argDimDevice) (*mcp.CallToolResult, any, error) {
+	log.Info("HandleDimDevice request", "args", args)
+	delta, err := parseBrightnessDelta(args.Change)
+	if err != nil {
+		return errorResult(err.Error()), nil, nil
+	}
+	result, adjusted := AdjustBrightness(ctx, deviceIDs(args.Devices), delta)
+	log.Info("AdjustBrightness result", "result", result, "adjusted", adjusted)
+	// A dry run adjusts nothing, but is not a failure.
+	if !adjusted && !DRY_RUN {
+		return errorResult(result), nil, nil
+	}
+	return simpleResult(result), nil, nil
+}
+
+var list_rooms = &mcp.Tool{
+	Name:        "list_rooms",
+	Description: `Get all rooms (positions) under the user's current home, the valid positions to filter devices by.
+Returns:
+  Newline-separated list of room names, or JSON if requested.`,
+	InputSchema: inputSchema[argFormat](constraints{
+		"format": oneOf(resultFormats),
+	}),
+}
+
+// HandleListRooms handles querying the rooms of the current home.
+//
+// Along with the text, the rooms are returned as structured content.
+func HandleListRooms(ctx context.Context, req *mcp.CallToolRequest, args argFormat) (*mcp.CallToolResult, *RoomsOutput, error) {
+	log.Info("HandleListRooms request")
+	rooms, message := GetPositions(ctx)
+	if message != "" {
+		log.Error("GetPositions failed", "message", message)
+		return errorResult(message), &RoomsOutput{Rooms: []string{}}, nil
+	}
+	log.Info("Rooms retrieved", "rooms", rooms)
+	rooms = orEmpty(rooms)
+	text := strings.Join(rooms, "\n")
+	if len(rooms) == 0 {
+		text = tr("No rooms found.")
+	}
+	return simpleResult(resultText(args.Format, rooms, text)), &RoomsOutput{Rooms: rooms}, nil
+}
+
+var query_devices = &mcp.Tool{
+	Name:        "query_devices",
+	Description: `Query devices under the user's home, optionally filtered by positions (rooms) and device types.
+Returns:
+  Devices information in Markdown format, or JSON if requested`,
+	InputSchema: inputSchema[argDeviceQuery](constraints{
+		"format": oneOf(resultFormats),
+	}),
+}
+type argDeviceQuery struct {
+	Positions []string `json:"positions,omitempty" jsonschema:"the positions (rooms) to query as listed by list_rooms, empty means the server's default positions if configured, [\"*\"] means all positions"`
+	Types     []string `json:"types,omitempty" jsonschema:"the device types to query, empty means the server's default device types if configured, [\"*\"] means all device types"`
+	Format    string   `json:"format,omitempty" jsonschema:"optional result format, markdown (default) or json"`
+}
+// HandleDeviceQuery handles querying devices.
+//
+// Along with the Markdown text, the devices are returned as structured content.
+func HandleDeviceQuery(ctx context.Context, req *mcp.CallToolRequest, args argDeviceQuery) (*mcp.CallToolResult, *DevicesOutput, error) {
+	log.Info("HandleDeviceQuery request", "args", args)
+	text, err := queryDevices(ctx, "DeviceQuery", queryFilter(args.Positions, DEFAULT_POSITIONS), queryFilter(args.Types, DEFAULT_DEVICE_TYPES))
+	if err != nil {
+		log.Error("DeviceQuery failed", "err", err)
+		return errorResult(err.Error()), &DevicesOutput{Devices: []Device{}}, nil
+	}
+	result, devices := queryResult("DeviceQuery", args.Format, text, tr("No device data available"), parseDevices)
+	log.Info("DeviceQuery result", "devices", len(devices))
+	return result, &DevicesOutput{Devices: devices}, nil
+}
+
+var query_device_status = &mcp.Tool{
+	Name:        "query_device_status",
+	Description: `Query the current status of devices under the user's home, optionally filtered by positions (rooms) and device types.
+Returns:
+  Device status information in Markdown format, or JSON if requested`,
+	InputSchema: inputSchema[argDeviceQuery](constraints{
+		"format": oneOf(resultFormats),
+	}),
+}
+
+// HandleDeviceStatusQuery handles querying device status.
+//
+// Along with the Markdown text, the devices and their status are returned as structured content.
+func HandleDeviceStatusQuery(ctx context.Context, req *mcp.CallToolRequest, args argDeviceQuery) (*mcp.CallToolResult, *DevicesOutput, error) {
+	log.Info("HandleDeviceStatusQuery request", "args", args)
+	text, err := queryDevices(ctx, "DeviceStatusQuery", queryFilter(args.Positions, DEFAULT_POSITIONS), queryFilter(args.Types, DEFAULT_DEVICE_TYPES))
+	if err != nil {
+		log.Error("DeviceStatusQuery failed", "err", err)
+		return errorResult(err.Error()), &DevicesOutput{Devices: []Device{}}, nil
+	}
+	result, devices := queryResult("DeviceStatusQuery", args.Format, text, tr("No device status data available"), parseDevices)
+	log.Info("DeviceStatusQuery result", "devices", len(devices))
+	return result, &DevicesOutput{Devices: devices}, nil
+}
+
+// queryResult builds the result of a query tool from the backend's text: the text itself, or
+// the decoded items as JSON if format asks for it. If the text cannot be decoded, it is
+// returned as is and the items are empty, so the tool still works without structured content.
+func queryResult[T any](serviceName, format, text, empty string, parse func(string) ([]T, error)) (*mcp.CallToolResult, []T) {
+	items, err := parse(text)
+	if err != nil {
+		log.Warn("Failed to decode query result, returning its text only", "service", serviceName, "err", err)
+		format = formatMarkdown
+	}
+	if strings.TrimSpace(text) == "" {
+		text = empty
+	}
+	return simpleResult(resultText(format, orEmpty(items), text)), orEmpty(items)
+}
+
+var schedule_device_task = &mcp.Tool{
+	Name:        "schedule_device_task",
+	Description: `Schedule a device control task under the user's home, e.g. turn off the living room lights at 11pm.
+Returns:
+  Task scheduling result message.`,
+	InputSchema: inputSchema[argAutomationConfig](constraints{
+		"scheduled_time": nonEmptyString,
+		"endpoint_ids":   nonEmptyList,
+		"control_params": nonEmptyObject,
+		"task_name":      nonEmptyString,
+	}),
+}
+type argAutomationConfig struct {
+	ScheduledTime  string         `json:"scheduled_time" jsonschema:"the time to execute the task in crontab format 'minute hour day month weekday', e.g. '0 23 * * *' for 23:00 every day, '0 9 * * 1' for 9:00 every Monday, a one-time task needs a single minute and hour"`
+	EndpointIDs    []deviceID     `json:"endpoint_ids" jsonschema:"the device ids to control"`
+	ControlParams  map[string]any `json:"control_params" jsonschema:"the control parameters to apply, keyed by attribute name"`
+	TaskName       string         `json:"task_name" jsonschema:"a short name describing the task"`
+	ExecutionOnce  bool           `json:"execution_once,omitempty" jsonschema:"true to execute the task only once, false to execute it periodically"`
+	IdempotencyKey string         `json:"idempotency_key,omitempty" jsonschema:"optional unique key for this task, reuse the same key when retrying so it is created only once"`
+	TimeZone       string         `json:"time_zone,omitempty" jsonschema:"optional time zone of scheduled_time, an IANA name like 'America/New_York' or an offset like '+08:00', empty means the home time zone"`
+}
+// HandleAutomationConfig handles scheduling a device control task.
+func HandleAutomationConfig(ctx context.Context, req *mcp.CallToolRequest, args argAutomationConfig) (*mcp.CallToolResult, any, error) {
+	log.Info("HandleAutomationConfig request", "args", args)
+	if strings.TrimSpace(args.ScheduledTime) == "" {
+		return errorResult(tr("Scheduled time cannot be empty")), nil, nil
+	}
+	if err := validateSchedule(args.ScheduledTime, args.ExecutionOnce); err != nil {
+		return errorResult(tr("Invalid scheduled time %q: %v", args.ScheduledTime, err)), nil, nil
+	}
+	if len(args.EndpointIDs) == 0 {
+		return errorResult(tr("Device list cannot be empty")), nil, nil
+	}
+	if len(args.ControlParams) == 0 {
+		return errorResult(tr("Control parameters cannot be empty")), nil, nil
+	}
+	if strings.TrimSpace(args.TaskName) == "" {
+		return errorResult(tr("Task name cannot be empty")), nil, nil
+	}
+	result := AutomationConfig(ctx, args.ScheduledTime, deviceIDs(args.EndpointIDs), args.ControlParams, args.TaskName, args.ExecutionOnce, args.IdempotencyKey, args.TimeZone)
+	log.Info("AutomationConfig result", "result", result)
+	return simpleResult(result), nil, nil
+}
+
+var list_scheduled_tasks = &mcp.Tool{
+	Name:        "list_scheduled_tasks",
+	Description: `List the scheduled device control tasks under the user's home, e.g. to find a task to cancel.
+Returns:
+  Markdown formatted task information including the task ids.`,
+}
+
+// HandleListAutomations handles listing the scheduled tasks.
+func HandleListAutomations(ctx context.Context, req *mcp.CallToolRequest, args struct{}) (*mcp.CallToolResult, any, error) {
+	log.Info("HandleListAutomations request")
+	result := ListAutomations(ctx)
+	log.Info("ListAutomations result", "result", result)
+	return simpleResult(result), nil, nil
+}
+
+var cancel_scheduled_task = &mcp.Tool{
+	Name:        "cancel_scheduled_task",
+	Description: `Cancel a scheduled device control task under the user's home, e.g. the task set for 11pm.
+Returns:
+  Task cancellation result message.`,
+	InputSchema: inputSchema[argCancelAutomation](constraints{
+		"task_id": nonEmptyString,
+	}),
+}
+type argCancelAutomation struct {
+	TaskID string `json:"task_id" jsonschema:"the id of the task to cancel, as listed by list_scheduled_tasks"`
+}
+// HandleCancelAutomation handles cancelling a scheduled task.
+func HandleCancelAutomation(ctx context.Context, req *mcp.CallToolRequest, args argCancelAutomation) (*mcp.CallToolResult, any, error) {
+	log.Info("HandleCancelAutomation request", "args", args)
+	if strings.TrimSpace(args.TaskID) == "" {
+		return errorResult(tr("Task id cannot be empty")), nil, nil
+	}
+	result := CancelAutomation(ctx, args.TaskID)
+	log.Info("CancelAutomation result", "result", result)
+	return simpleResult(result), nil, nil
+}
+
+var online_status = &mcp.Tool{
+	Name:        "online_status",
+	Description: `Tell whether devices under the user's home are online, e.g. whether a sensor is offline before trusting its readings.
+Returns:
+  Each device with online, offline, or unknown if the device does not report its reachability.`,
+	InputSchema: inputSchema[argOnlineStatus](constraints{
+		"endpoint_ids": {Items: between(1, math.MaxInt32)},
+	}),
+}
+type argOnlineStatus struct {
+	EndpointIDs []deviceID `json:"endpoint_ids,omitempty" jsonschema:"optional device ids to check, empty means all devices in the positions"`
+	Positions   []string   `json:"positions,omitempty" jsonschema:"optional positions (rooms) to check as listed by list_rooms, empty means all positions"`
+}
+// HandleOnlineStatus handles querying whether devices are online.
+//
+// Along with the text, the devices are returned as structured content.
+func HandleOnlineStatus(ctx context.Context, req *mcp.CallToolRequest, args argOnlineStatus) (*mcp.CallToolResult, *OnlineOutput, error) {
+	log.Info("HandleOnlineStatus request", "args", args)
+	output, result, message := OnlineStatus(ctx, orEmpty(args.Positions), deviceIDs(args.EndpointIDs))
+	if message != "" {
+		log.Error("OnlineStatus failed", "message", message)
+		return errorResult(message), &OnlineOutput{Devices: []DeviceOnline{}}, nil
+	}
+	log.Info("OnlineStatus result", "devices", len(output.Devices))
+	return simpleResult(result), output, nil
+}
+
+var query_power = &mcp.Tool{
+	Name:        "query_power",
+	Description: `Query the power draw and energy consumption of devices under the user's home, e.g. how much power the air conditioner uses, optionally with the metering logs within a time span.
+Returns:
+  The watts and kWh of each metered device, the devices without power metering, and the metering logs if a time span is given.`,
+	InputSchema: inputSchema[argPowerQuery](constraints{
+		"endpoint_ids": nonEmptyList,
+	}),
+}
+type argPowerQuery struct {
+	EndpointIDs   []deviceID `json:"endpoint_ids" jsonschema:"the device ids to query power for"`
+	StartDatetime string     `json:"start_datetime,omitempty" jsonschema:"optional start of the time span of the metering logs in format 'YYYY-MM-DD HH:MM:SS'"`
+	EndDatetime   string     `json:"end_datetime,omitempty" jsonschema:"optional end of the time span of the metering logs in format 'YYYY-MM-DD HH:MM:SS'"`
+}
+// HandlePowerQuery handles querying the power metering of devices.
+//
+// Along with the text, the metering is returned as structured content.
+func HandlePowerQuery(ctx context.Context, req *mcp.CallToolRequest, args argPowerQuery) (*mcp.CallToolResult, *PowerOutput, error) {
+	log.Info("HandlePowerQuery request", "args", args)
+	output, result, message := QueryPower(ctx, deviceIDs(args.EndpointIDs), args.StartDatetime, args.EndDatetime)
+	if message != "" {
+		log.Error("QueryPower failed", "message", message)
+		return errorResult(message), &PowerOutput{Devices: []PowerUsage{}, Unmetered: []int{}}, nil
+	}
+	log.Info("QueryPower result", "metered", len(output.Devices), "unmetered", output.Unmetered)
+	return simpleResult(result), output, nil
+}
+
+var query_device_logs = &mcp.Tool{
+	Name:        "query_device_logs",
+	Description: `Query the historical logs of devices under the user's home within an optional time span.
+Returns:
+  Device logs information in Markdown format`,
+	InputSchema: inputSchema[argDeviceLogQuery](constraints{
+		"endpoint_ids": nonEmptyList,
+		"limit":        between(0, math.MaxInt32),
+		"offset":       between(0, math.MaxInt32),
+	}),
+}
+type argDeviceLogQuery struct {
+	EndpointIDs   []deviceID `json:"endpoint_ids" jsonschema:"the device ids to query logs for"`
+	StartDatetime string     `json:"start_datetime,omitempty" jsonschema:"optional start of the time span in format 'YYYY-MM-DD HH:MM:SS' of the home time zone, or followed by an offset like '+08:00'"`
+	EndDatetime   string     `json:"end_datetime,omitempty" jsonschema:"optional end of the time span in format 'YYYY-MM-DD HH:MM:SS' of the home time zone, or followed by an offset like '+08:00'"`
+	Attributes    []string   `json:"attributes,omitempty" jsonschema:"optional device attributes to query logs for, empty means all attributes"`
+	Limit         int        `json:"limit,omitempty" jsonschema:"optional maximum number of logs to return, all logs when 0"`
+	Offset        int        `json:"offset,omitempty" jsonschema:"optional number of logs to skip, used with limit to fetch the next page"`
+}
+// HandleDeviceLogQuery handles querying device logs.
+func HandleDeviceLogQuery(ctx context.Context, req *mcp.CallToolRequest, args argDeviceLogQuery) (*mcp.CallToolResult, any, error) {
+	log.Info("HandleDeviceLogQuery request", "args", args)
+	result := DeviceLogQuery(ctx, deviceIDs(args.EndpointIDs), args.StartDatetime, args.EndDatetime, args.Attributes, args.Limit, args.Offset)
+	log.Info("DeviceLogQuery result", "result", result)
+	return simpleResult(result), nil, nil
+}
+
+var login = &mcp.Tool{
+	Name:        "login",
+	Description: `Log in to the user's account with username and password in a region.
+Returns:
+  The account region on success, or the failure message.`,
+	InputSchema: inputSchema[argLogin](constraints{
+		"username": nonEmptyString,
+		"password": nonEmptyString,
+		"region":   oneOf(SupportedRegions),
+	}),
+}
+type argLogin struct {
+	Username string `json:"username" jsonschema:"the account username"`
+	Password string `json:"password" jsonschema:"the account password"`
+	Region   string `json:"region,omitempty" jsonschema:"the account region, one of CN, US, EU, KR, optional if the server has a default region"`
+}
+
+// HandleLogin handles logging in to the user's account.
+func HandleLogin(ctx context.Context, req *mcp.CallToolRequest, args argLogin) (*mcp.CallToolResult, any, error) {
+	// Never log the password.
+	log.Info("HandleLogin request", "username", args.Username, "region", args.Region)
+	result, message := Login(ctx, args.Username, args.Password, args.Region)
+	if message != "" {
+		log.Error("Login failed", "username", args.Username, "message", message)
+		return errorResult(message), nil, nil
+	}
+	if result == nil {
+		return errorResult(tr("Login failed: no response from server")), nil, nil
+	}
+	log.Info("Logged in", "username", args.Username, "region", result.Region)
+	return simpleResult(tr("Successfully logged in, region: %s", result.Region)), nil, nil
+}
+
+var logout = &mcp.Tool{
+	Name:        "logout",
+	Description: `Log out of the current account, invalidating its session token.
+Returns:
+  Logout result message.`,
+}
+
+// HandleLogout handles invalidating the current session token.
+func HandleLogout(ctx context.Context, req *mcp.CallToolRequest, args struct{}) (*mcp.CallToolResult, any, error) {
+	log.Info("HandleLogout request")
+	result := Logout(ctx)
+	log.Info("Logout result", "result", result)
+	return simpleResult(result), nil, nil
+}
+
+var server_info = &mcp.Tool{
+	Name:        "server_info",
+	Description: `Get the version and identity of this server, useful when debugging which build is running.
+Returns:
+  Server version, app id, device id prefix, account region and transport.`,
+}
+
+// HandleServerInfo handles reporting the server version and identity.
+func HandleServerInfo(ctx context.Context, req *mcp.CallToolRequest, args struct{}) (*mcp.CallToolResult, any, error) {
+	log.Info("HandleServerInfo request")
+	region := currentRegion(ctx)
+	if region == "" {
+		region = LOGIN_REGION
+	}
+	return simpleResult(strings.Join([]string{
+		tr("Version: %s", Version),
+		tr("App ID: %s", AppID),
+		tr("Device ID: %s", deviceIDPrefix(DeviceID)),
+		tr("Region: %s", region),
+		tr("Transport: %s", *transport),
+	}, "\n")), nil, nil
+}
+
+// deviceIDPrefix shortens a device id for display, keeping its "mcp0."/"mcp1." prefix and
+// the first characters of the hash.
+func deviceIDPrefix(id string) string {
+	if len(id) <= 13 {
+		return id
+	}
+	return id[:13] + "..."
+}
+
+var call_service = &mcp.Tool{
+	Name:        "call_service",
+	Description: `Call a cloud service by name with raw parameters, for services without a dedicated tool. Prefer the dedicated tools whenever one fits.
+Returns:
+  The raw JSON result of the service.`,
+	InputSchema: inputSchema[argCallService](constraints{
+		"fn": nonEmptyString,
+	}),
+}
+type argCallService struct {
+	Fn     string         `json:"fn" jsonschema:"the name of the service to call, e.g. DeviceQuery"`
+	Params map[string]any `json:"params,omitempty" jsonschema:"the parameters of the service"`
+}
+// HandleCallService handles calling an arbitrary service, registered only when ENABLE_RAW_CALL is set.
+func HandleCallService(ctx context.Context, req *mcp.CallToolRequest, args argCallService) (*mcp.CallToolResult, any, error) {
+	log.Info("HandleCallService request", "fn", args.Fn, "params", redactArgs(args.Params))
+	if strings.TrimSpace(args.Fn) == "" {
+		return errorResult(tr("Service name cannot be empty")), nil, nil
+	}
+	params := args.Params
+	if params == nil {
+		params = map[string]any{}
+	}
+	result, err := CallServiceRaw(ctx, strings.TrimSpace(args.Fn), params)
+	if err != nil {
+		log.Error("CallService failed", "fn", args.Fn, "err", err)
+		return errorResult(err.Error()), nil, nil
+	}
+	if len(result) == 0 {
+		return simpleResult("null"), nil, nil
+	}
+	return simpleResult(string(result)), nil, nil
+}
+
 func registerTools(server *mcp.Server) {
-	// mcp.AddTool(server, list_home, HandleListHome);
-	// mcp.AddTool(server, switch_home, HandleSwitchHome)
-	a, b := SwitchHome("我的家")
-	log.Info("Switching home", a, b)
-	mcp.AddTool(server, list_scenes, HandleListScenesHandler)
-	mcp.AddTool(server, run_scenes, HandleRunScenesHandler)
+	tools := &toolSet{server: server}
+	addTool(tools, localizeTool(list_home), HandleListHome)
+	addTool(tools, localizeTool(get_current_home), HandleGetCurrentHome)
+	addTool(tools, localizeTool(switch_home), HandleSwitchHome)
+	listScenes := localizeTool(list_scenes)
+	if notes := loadNotes(NOTES_FILE); notes != "" {
+		listScenes.Description += "\nNOTES:\n" + notes
+	}
+	addTool(tools, listScenes, HandleListScenesHandler)
+	addTool(tools, localizeTool(run_scenes), HandleRunScenesHandler)
+	addTool(tools, localizeTool(run_scene_by_name), HandleRunSceneByName)
+	addTool(tools, localizeTool(control_device), HandleDeviceControl)
+	addTool(tools, localizeTool(set_light), HandleSetLight)
+	addTool(tools, localizeTool(toggle_device), HandleToggleDevice)
+	addTool(tools, localizeTool(dim_device), HandleDimDevice)
+	addTool(tools, localizeTool(list_rooms), HandleListRooms)
+	addTool(tools, localizeTool(query_devices), HandleDeviceQuery)
+	addTool(tools, localizeTool(query_device_status), HandleDeviceStatusQuery)
+	addTool(tools, localizeTool(get_device), HandleGetDevice)
+	addTool(tools, localizeTool(home_snapshot), HandleHomeSnapshot)
+	addTool(tools, localizeTool(schedule_device_task), HandleAutomationConfig)
+	addTool(tools, localizeTool(list_scheduled_tasks), HandleListAutomations)
+	addTool(tools, localizeTool(cancel_scheduled_task), HandleCancelAutomation)
+	addTool(tools, localizeTool(query_device_logs), HandleDeviceLogQuery)
+	addTool(tools, localizeTool(query_power), HandlePowerQuery)
+	addTool(tools, localizeTool(online_status), HandleOnlineStatus)
+	addTool(tools, localizeTool(login), HandleLogin)
+	addTool(tools, localizeTool(logout), HandleLogout)
+	addTool(tools, localizeTool(server_info), HandleServerInfo)
+	if ENABLE_RAW_CALL {
+		// The passthrough bypasses all argument validation, only expose it when asked to.
+		addTool(tools, localizeTool(call_service), HandleCallService)
+	}
+	for _, name := range slices.Concat(ENABLED_TOOLS, DISABLED_TOOLS) {
+		switch {
+		case slices.Contains(tools.registered, name) || slices.Contains(tools.disabled, name):
+		case name == call_service.Name && slices.Contains(ENABLED_TOOLS, name):
+			log.Warn("Tool in ENABLED_TOOLS requires ENABLE_RAW_CALL", "tool", name)
+		case name != call_service.Name:
+			log.Warn("Unknown tool in ENABLED_TOOLS or DISABLED_TOOLS", "tool", name)
+		}
+	}
+	log.Info("Registered tools", "tools", tools.registered, "disabled", tools.disabled)
+}
+
+// toolSet tracks the tools registered on a server and those left out by configuration.
+type toolSet struct {
+	server     *mcp.Server
+	registered []string
+	disabled   []string
+}
+
+// addTool registers the tool on the server of tools, unless it is missing from a non-empty
+// ENABLED_TOOLS or listed in DISABLED_TOOLS.
+func addTool[In, Out any](tools *toolSet, tool *mcp.Tool, handler mcp.ToolHandlerFor[In, Out]) {
+	if (len(ENABLED_TOOLS) > 0 && !slices.Contains(ENABLED_TOOLS, tool.Name)) || slices.Contains(DISABLED_TOOLS, tool.Name) {
+		tools.disabled = append(tools.disabled, tool.Name)
+		return
+	}
+	mcp.AddTool(tools.server, tool, handler)
+	tools.registered = append(tools.registered, tool.Name)
 }
\ No newline at end of file
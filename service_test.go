@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/devfans/golang/log"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// TestMain runs the tests with English messages, whatever LANG the environment sets.
+func TestMain(m *testing.M) {
+	LANG = "en"
+	os.Exit(m.Run())
+}
+
+// stubDoer answers upstream requests in place of the cloud service.
+type stubDoer func(request *http.Request) (*http.Response, error)
+
+func (f stubDoer) Do(request *http.Request) (*http.Response, error) {
+	return f(request)
+}
+
+// upstreamCall is a service call received by the stub upstream.
+type upstreamCall struct {
+	Fn        string
+	Params    json.RawMessage
+	RequestID string
+	Header    http.Header
+}
+
+// stubResponse returns a response with status and body.
+func stubResponse(status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+// okResponse returns a successful service response carrying result, encoded as JSON.
+func okResponse(result any) *http.Response {
+	data, _ := json.Marshal(map[string]any{"code": 0, "result": result})
+	return stubResponse(http.StatusOK, string(data))
+}
+
+// apiErrorResponse returns a service response failing with a business code.
+func apiErrorResponse(code int, message string) *http.Response {
+	data, _ := json.Marshal(map[string]any{"code": code, "message": message})
+	return stubResponse(http.StatusOK, string(data))
+}
+
+// stubUpstream routes upstream requests to handle for the duration of the test: secret
+// fetches get a fixed secret and service calls are passed to handle. The app secret, query
+// cache and circuit breaker start fresh and retries wait only a millisecond.
+func stubUpstream(t *testing.T, handle func(call upstreamCall) (*http.Response, error)) {
+	t.Helper()
+	restore := SetHTTPClient(stubDoer(func(request *http.Request) (*http.Response, error) {
+		if request.Method == http.MethodGet {
+			return stubResponse(http.StatusOK, `{"secret_key":"test-secret"}`), nil
+		}
+		var body struct {
+			Fn        string          `json:"fn"`
+			Params    json.RawMessage `json:"params"`
+			RequestID string          `json:"request_id"`
+		}
+		data, err := io.ReadAll(request.Body)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Errorf("invalid request body %s: %v", data, err)
+		}
+		return handle(upstreamCall{Fn: body.Fn, Params: body.Params, RequestID: body.RequestID, Header: request.Header})
+	}))
+	secrets, breaker, delay := AppSecrets, upstreamBreaker, API_RETRY_DELAY
+	AppSecrets = newSecretManager(0, fetchSecret)
+	upstreamBreaker = newCircuitBreaker(0, 0)
+	API_RETRY_DELAY = time.Millisecond
+	queryCache.Purge()
+	t.Cleanup(func() {
+		restore()
+		AppSecrets, upstreamBreaker, API_RETRY_DELAY = secrets, breaker, delay
+		queryCache.Purge()
+	})
+}
+
+// recordCalls returns a handler answering every call with respond and the calls it received.
+func recordCalls(respond func(call upstreamCall) *http.Response) (func(call upstreamCall) (*http.Response, error), func() []upstreamCall) {
+	var (
+		mu    sync.Mutex
+		calls []upstreamCall
+	)
+	handle := func(call upstreamCall) (*http.Response, error) {
+		mu.Lock()
+		calls = append(calls, call)
+		mu.Unlock()
+		return respond(call), nil
+	}
+	return handle, func() []upstreamCall {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]upstreamCall(nil), calls...)
+	}
+}
+
+// captureLogs records the log messages of all levels until the test ends and returns a
+// function reading what was logged so far.
+func captureLogs(t *testing.T) func() string {
+	var (
+		mu     sync.Mutex
+		output strings.Builder
+	)
+	handle := func(level string) log.Handle {
+		return func(msg string, args ...any) {
+			mu.Lock()
+			defer mu.Unlock()
+			output.WriteString(level + " " + log.Format(msg, args...) + "\n")
+		}
+	}
+	trace, debug, verbose, info, warn, errorf := log.Trace, log.Debug, log.Verbose, log.Info, log.Warn, log.Error
+	log.Trace, log.Debug, log.Verbose = handle("TRACE"), handle("DEBUG"), handle("VERBO")
+	log.Info, log.Warn, log.Error = handle("INFO"), handle("WARN"), handle("ERROR")
+	t.Cleanup(func() {
+		log.Trace, log.Debug, log.Verbose, log.Info, log.Warn, log.Error = trace, debug, verbose, info, warn, errorf
+	})
+	return func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return output.String()
+	}
+}
+
+// toolRequest returns a tool call request for calling handlers directly.
+func toolRequest() *mcp.CallToolRequest {
+	return &mcp.CallToolRequest{Params: &mcp.CallToolParams{}}
+}
+
+// contentText returns the text content of a tool result.
+func contentText(t *testing.T, result *mcp.CallToolResult) string {
+	t.Helper()
+	var texts []string
+	for _, content := range result.Content {
+		text, ok := content.(*mcp.TextContent)
+		if !ok {
+			t.Fatalf("unexpected content %T", content)
+		}
+		texts = append(texts, text.Text)
+	}
+	return strings.Join(texts, "\n")
+}
+
+func TestListScenesDecodesScenes(t *testing.T) {
+	handle, calls := recordCalls(func(call upstreamCall) *http.Response {
+		return okResponse(`[{"scene_id":1,"scene_name":"打开客厅灯","position_name":"客厅"},{"scene_id":2,"scene_name":"Movie night","position_name":"Living room"}]`)
+	})
+	stubUpstream(t, handle)
+
+	result, output, err := HandleListScenesHandler(context.Background(), toolRequest(), argFormat{})
+	if err != nil || result.IsError {
+		t.Fatalf("list scenes failed: %v %v", err, result)
+	}
+	want := []Scene{
+		{ID: 1, Name: "打开客厅灯", Position: "客厅"},
+		{ID: 2, Name: "Movie night", Position: "Living room"},
+	}
+	if len(output.Scenes) != len(want) {
+		t.Fatalf("got scenes %+v, want %+v", output.Scenes, want)
+	}
+	for i := range want {
+		if output.Scenes[i] != want[i] {
+			t.Errorf("scene %d: got %+v, want %+v", i, output.Scenes[i], want[i])
+		}
+	}
+	if text := contentText(t, result); !strings.Contains(text, "Movie night") {
+		t.Errorf("text does not list the scenes: %s", text)
+	}
+	if got := calls(); len(got) != 1 || got[0].Fn != "GetScenes" {
+		t.Errorf("got calls %+v, want a single GetScenes", got)
+	}
+}
+
+func TestQueryToolsKeepBackendText(t *testing.T) {
+	result := devicesMarkdown
+	handle, _ := recordCalls(func(call upstreamCall) *http.Response {
+		return okResponse(result)
+	})
+	stubUpstream(t, handle)
+	ctx := context.Background()
+
+	text, output, err := HandleDeviceQuery(ctx, toolRequest(), argDeviceQuery{Positions: []string{"*"}})
+	if err != nil || text.IsError || contentText(t, text) != devicesMarkdown {
+		t.Errorf("got text %q, want the backend's Markdown", contentText(t, text))
+	}
+	if len(output.Devices) != 2 || output.Devices[0].ID != 101 {
+		t.Errorf("got structured content %+v, want the decoded devices", output.Devices)
+	}
+
+	text, _, _ = HandleDeviceQuery(ctx, toolRequest(), argDeviceQuery{Positions: []string{"*"}, Format: formatJSON})
+	if got := contentText(t, text); !strings.Contains(got, `"endpoint_id": 102`) {
+		t.Errorf("got text %q, want the devices as JSON", got)
+	}
+
+	// A result that cannot be decoded is still returned, without structured content.
+	result = "客厅主灯：开"
+	queryCache.Purge()
+	text, output, err = HandleDeviceStatusQuery(ctx, toolRequest(), argDeviceQuery{Positions: []string{"*"}, Format: formatJSON})
+	if err != nil || text.IsError || contentText(t, text) != result {
+		t.Errorf("got text %q, want the backend's text", contentText(t, text))
+	}
+	if output == nil || output.Devices == nil || len(output.Devices) != 0 {
+		t.Errorf("got structured content %+v, want it empty", output)
+	}
+	scenes, sceneOutput, _ := HandleListScenesHandler(ctx, toolRequest(), argFormat{})
+	if scenes.IsError || contentText(t, scenes) != result || len(sceneOutput.Scenes) != 0 {
+		t.Errorf("got %q %+v, want the backend's text without scenes", contentText(t, scenes), sceneOutput)
+	}
+}
+
+func TestGetDeviceJSONIsAnArray(t *testing.T) {
+	handle, _ := recordCalls(func(call upstreamCall) *http.Response {
+		if call.Fn == "DeviceStatusQuery" {
+			return okResponse(statusMarkdown)
+		}
+		return okResponse(devicesMarkdown)
+	})
+	stubUpstream(t, handle)
+
+	result, _, err := HandleGetDevice(context.Background(), toolRequest(), argGetDevice{Name: "客厅主灯", Format: formatJSON})
+	if err != nil || result.IsError {
+		t.Fatalf("get device failed: %v %s", err, contentText(t, result))
+	}
+	var devices []Device
+	if err := json.Unmarshal([]byte(contentText(t, result)), &devices); err != nil || len(devices) != 1 || devices[0].ID != 101 {
+		t.Errorf("got %s %v, want a JSON array of the device", contentText(t, result), err)
+	}
+}
+
+func TestRunScenesResult(t *testing.T) {
+	handle, calls := recordCalls(func(call upstreamCall) *http.Response {
+		return okResponse(nil)
+	})
+	stubUpstream(t, handle)
+
+	result, _, err := HandleRunScenesHandler(context.Background(), toolRequest(), argScenes{Buttons: []int{3, 3, 4}})
+	if err != nil || result.IsError {
+		t.Fatalf("run scenes failed: %v %v", err, result)
+	}
+	if text, want := contentText(t, result), tr("Scene executed successfully"); text != want {
+		t.Errorf("got %q, want %q", text, want)
+	}
+	got := calls()
+	if len(got) != 1 || got[0].Fn != "RunScenes" {
+		t.Fatalf("got calls %+v, want a single RunScenes", got)
+	}
+	if params := string(got[0].Params); params != `{"scenes":[3,4]}` {
+		t.Errorf("got params %s, want the deduplicated buttons", params)
+	}
+}
+
+func TestServiceBusinessError(t *testing.T) {
+	handle, calls := recordCalls(func(call upstreamCall) *http.Response {
+		return apiErrorResponse(2001, "home not found")
+	})
+	stubUpstream(t, handle)
+
+	result, _, err := HandleListScenesHandler(context.Background(), toolRequest(), argFormat{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.IsError {
+		t.Fatalf("got a successful result for business code 2001: %v", contentText(t, result))
+	}
+	if text := contentText(t, result); !strings.Contains(text, "home not found") {
+		t.Errorf("error text does not carry the backend message: %s", text)
+	}
+	if got := calls(); len(got) != 1 {
+		t.Errorf("got %d calls, want 1: a business error is not retried", len(got))
+	}
+
+	_, err = CallService[string](context.Background(), "GetHomes", nil)
+	apiErr, ok := err.(*APIError)
+	if !ok || apiErr.Code != 2001 {
+		t.Errorf("got error %v, want *APIError with code 2001", err)
+	}
+}
+
+func TestStructuredOutputOnError(t *testing.T) {
+	handle, _ := recordCalls(func(call upstreamCall) *http.Response {
+		return apiErrorResponse(2001, "home not found")
+	})
+	stubUpstream(t, handle)
+	ctx, req := context.Background(), toolRequest()
+	for name, call := range map[string]func() (*mcp.CallToolResult, any){
+		"list_device_control_buttons": func() (*mcp.CallToolResult, any) {
+			result, output, _ := HandleListScenesHandler(ctx, req, argFormat{})
+			return result, output
+		},
+		"list_rooms": func() (*mcp.CallToolResult, any) {
+			result, output, _ := HandleListRooms(ctx, req, argFormat{})
+			return result, output
+		},
+		"query_devices": func() (*mcp.CallToolResult, any) {
+			result, output, _ := HandleDeviceQuery(ctx, req, argDeviceQuery{})
+			return result, output
+		},
+		"query_device_status": func() (*mcp.CallToolResult, any) {
+			result, output, _ := HandleDeviceStatusQuery(ctx, req, argDeviceQuery{})
+			return result, output
+		},
+		"online_status": func() (*mcp.CallToolResult, any) {
+			result, output, _ := HandleOnlineStatus(ctx, req, argOnlineStatus{})
+			return result, output
+		},
+		"query_power": func() (*mcp.CallToolResult, any) {
+			result, output, _ := HandlePowerQuery(ctx, req, argPowerQuery{EndpointIDs: []deviceID{1}})
+			return result, output
+		},
+	} {
+		result, output := call()
+		if !result.IsError {
+			t.Errorf("%s: got a successful result: %s", name, contentText(t, result))
+		}
+		data, err := json.Marshal(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "null") {
+			t.Errorf("%s: got structured content %s, want empty lists", name, data)
+		}
+	}
+}
+
+func TestRegisterToolsWarnings(t *testing.T) {
+	setForTest(t, &ENABLED_TOOLS, []string{"list_homes", "call_service", "no_such_tool"})
+	setForTest(t, &ENABLE_RAW_CALL, false)
+	logs := captureLogs(t)
+
+	registerTools(mcp.NewServer(&mcp.Implementation{Name: "test"}, nil))
+	output := logs()
+	if !strings.Contains(output, "requires ENABLE_RAW_CALL") || strings.Count(output, "tool=call_service") != 1 {
+		t.Errorf("call_service not reported as requiring ENABLE_RAW_CALL:\n%s", output)
+	}
+	if !strings.Contains(output, "no_such_tool") {
+		t.Errorf("unknown tool not reported:\n%s", output)
+	}
+}
+
+func TestLoginNeverLogsPassword(t *testing.T) {
+	const password = "p4ssw0rd-do-not-log"
+	var n atomic.Int32
+	handle, _ := recordCalls(func(call upstreamCall) *http.Response {
+		switch n.Add(1) {
+		case 1:
+			return okResponse(LoginResult{Token: "token", Region: "CN"})
+		case 2:
+			return apiErrorResponse(1001, "wrong password")
+		case 3:
+			return apiErrorResponse(CodeTokenExpired, "token expired")
+		}
+		return okResponse(LoginResult{Token: "token", Region: "CN"})
+	})
+	stubUpstream(t, handle)
+	logs := captureLogs(t)
+	t.Cleanup(func() { setLoginToken("", "") })
+
+	args := argLogin{Username: "user", Password: password, Region: "cn"}
+	if result, _, _ := HandleLogin(context.Background(), toolRequest(), args); result.IsError {
+		t.Fatalf("login failed: %s", contentText(t, result))
+	}
+	if result, _, _ := HandleLogin(context.Background(), toolRequest(), args); !result.IsError {
+		t.Fatal("got a successful login for a rejected password")
+	}
+	// An expired token logs in again with the configured credentials.
+	setForTest(t, &LOGIN_USERNAME, "user")
+	setForTest(t, &LOGIN_PASSWORD, password)
+	CallService[any](context.Background(), "GetHomes", nil)
+
+	if n.Load() < 4 {
+		t.Fatalf("got %d calls, want the re-login to have happened", n.Load())
+	}
+	output := logs()
+	if output == "" {
+		t.Fatal("nothing logged")
+	}
+	if strings.Contains(output, password) {
+		t.Errorf("password logged:\n%s", output)
+	}
+}
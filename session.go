@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/devfans/golang/log"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// sessionCredentials is the login state of an MCP session that called the login tool.
+type sessionCredentials struct {
+	Token  string
+	Region string
+}
+
+// Sessions is the credential store of the MCP sessions.
+var Sessions = NewSessionRegistry[sessionCredentials](SESSION_IDLE_TTL, 0)
+
+type sessionEntry[V any] struct {
+	value    V
+	lastSeen time.Time
+}
+
+// SessionRegistry holds a value per MCP session, the one place for session-scoped state
+// like credentials or rate limit buckets. It is safe for concurrent use.
+//
+// Entries are keyed by the session itself, since session ids are empty for SSE sessions,
+// and are dropped once the session ends. Entries of sessions that went away without ending,
+// unused for longer than idleTTL, are evicted too, a zero idleTTL keeps them. With a
+// non-zero maxSessions, the least recently used entry is evicted to make room for a new one.
+type SessionRegistry[V any] struct {
+	mu          sync.Mutex
+	idleTTL     time.Duration
+	maxSessions int
+	entries     map[mcp.Session]*sessionEntry[V]
+	lastSweep   time.Time
+}
+
+// NewSessionRegistry returns an empty registry evicting entries after idleTTL and beyond maxSessions.
+func NewSessionRegistry[V any](idleTTL time.Duration, maxSessions int) *SessionRegistry[V] {
+	return &SessionRegistry[V]{
+		idleTTL:     idleTTL,
+		maxSessions: maxSessions,
+		entries:     make(map[mcp.Session]*sessionEntry[V]),
+		lastSweep:   time.Now(),
+	}
+}
+
+// Get returns the value of session, if it has one.
+func (r *SessionRegistry[V]) Get(session mcp.Session) (V, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.sweep(now)
+	entry, ok := r.entries[session]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	entry.lastSeen = now
+	return entry.value, true
+}
+
+// Set stores the value of session until it ends.
+func (r *SessionRegistry[V]) Set(session mcp.Session, value V) {
+	r.Update(session, func(V, bool) V { return value })
+}
+
+// Update replaces the value of session with the result of update, called with the current
+// value if any while holding the registry's lock, so a read-modify-write is atomic.
+func (r *SessionRegistry[V]) Update(session mcp.Session, update func(value V, ok bool) V) V {
+	r.mu.Lock()
+	now := time.Now()
+	r.sweep(now)
+	entry, existed := r.entries[session]
+	if !existed {
+		if r.maxSessions > 0 && len(r.entries) >= r.maxSessions {
+			r.evictOldest()
+		}
+		entry = &sessionEntry[V]{}
+		r.entries[session] = entry
+	}
+	entry.value = update(entry.value, existed)
+	entry.lastSeen = now
+	value := entry.value
+	r.mu.Unlock()
+
+	if ss, ok := session.(*mcp.ServerSession); ok && !existed {
+		go func() {
+			ss.Wait()
+			r.Delete(session)
+			log.Debug("Session ended, dropped its state")
+		}()
+	}
+	return value
+}
+
+// Delete drops the value of session.
+func (r *SessionRegistry[V]) Delete(session mcp.Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.entries, session)
+}
+
+// Len returns the number of sessions holding a value.
+func (r *SessionRegistry[V]) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.entries)
+}
+
+// sweep evicts the entries unused for longer than idleTTL, at most once per idleTTL.
+func (r *SessionRegistry[V]) sweep(now time.Time) {
+	if r.idleTTL <= 0 || now.Sub(r.lastSweep) <= r.idleTTL {
+		return
+	}
+	for session, entry := range r.entries {
+		if now.Sub(entry.lastSeen) > r.idleTTL {
+			delete(r.entries, session)
+		}
+	}
+	r.lastSweep = now
+}
+
+// evictOldest evicts the least recently used entry.
+func (r *SessionRegistry[V]) evictOldest() {
+	var (
+		oldest   mcp.Session
+		lastSeen time.Time
+		found    bool
+	)
+	for session, entry := range r.entries {
+		if !found || entry.lastSeen.Before(lastSeen) {
+			oldest, lastSeen, found = session, entry.lastSeen, true
+		}
+	}
+	delete(r.entries, oldest)
+}
+
+// sessionHomes holds the home each session last switched to or found current, for logging.
+var sessionHomes = NewSessionRegistry[string](SESSION_IDLE_TTL, 0)
+
+// globalHome is the home last switched to or found current outside of a session.
+var globalHome atomic.Pointer[string]
+
+// rememberHome records home as the current home of the session of ctx, or globally outside of a session.
+func rememberHome(ctx context.Context, home string) {
+	if session := sessionFromContext(ctx); session != nil {
+		sessionHomes.Set(session, home)
+		return
+	}
+	globalHome.Store(&home)
+}
+
+// homeName returns the current home known for session, falling back to the global one,
+// or empty if none is known yet.
+func homeName(session mcp.Session) string {
+	if session != nil {
+		if home, ok := sessionHomes.Get(session); ok {
+			return home
+		}
+	}
+	if home := globalHome.Load(); home != nil {
+		return *home
+	}
+	return ""
+}
+
+type sessionKey struct{}
+
+// withSession returns a context carrying the MCP session a request belongs to.
+func withSession(ctx context.Context, session mcp.Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, session)
+}
+
+// sessionFromContext returns the MCP session carried by ctx, or nil outside of a session.
+func sessionFromContext(ctx context.Context) mcp.Session {
+	session, _ := ctx.Value(sessionKey{}).(mcp.Session)
+	return session
+}
+
+// sessionMiddleware makes the session of each request available to upstream calls, which pick
+// the session's credentials from the context.
+func sessionMiddleware(next mcp.MethodHandler) mcp.MethodHandler {
+	return func(ctx context.Context, method string, req mcp.Request) (mcp.Result, error) {
+		return next(withSession(ctx, req.GetSession()), method, req)
+	}
+}
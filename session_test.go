@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+func TestSessionsKeepTheirTokens(t *testing.T) {
+	setForTest(t, &Sessions, NewSessionRegistry[sessionCredentials](0, 0))
+	setForTest(t, &API_KEY, "api-key")
+	alice := withSession(context.Background(), new(mcp.ClientSession))
+	bob := withSession(context.Background(), new(mcp.ClientSession))
+
+	storeLogin(alice, "alice-token", "CN")
+	storeLogin(bob, "bob-token", "US")
+	if got := currentToken(alice); got != "alice-token" {
+		t.Errorf("got token %q for alice", got)
+	}
+	if got := currentToken(bob); got != "bob-token" {
+		t.Errorf("got token %q for bob", got)
+	}
+	if got := currentRegion(bob); got != "US" {
+		t.Errorf("got region %q for bob", got)
+	}
+	if got := currentToken(context.Background()); got != "api-key" {
+		t.Errorf("got token %q outside of a session, want API_KEY", got)
+	}
+
+	clearLogin(alice)
+	if got := currentToken(alice); got != "api-key" {
+		t.Errorf("got token %q for alice after logout, want API_KEY", got)
+	}
+	if got := currentToken(bob); got != "bob-token" {
+		t.Errorf("got token %q for bob after alice logged out", got)
+	}
+}
+
+func TestSessionRegistryEvictsIdle(t *testing.T) {
+	registry := NewSessionRegistry[string](50*time.Millisecond, 0)
+	idle, active := new(mcp.ClientSession), new(mcp.ClientSession)
+	registry.Set(idle, "idle")
+	registry.Set(active, "active")
+
+	for range 8 {
+		time.Sleep(10 * time.Millisecond)
+		if _, ok := registry.Get(active); !ok {
+			t.Fatal("evicted a session in use")
+		}
+	}
+	if _, ok := registry.Get(idle); ok {
+		t.Error("kept a session idle for longer than the TTL")
+	}
+	if n := registry.Len(); n != 1 {
+		t.Errorf("got %d sessions, want only the active one", n)
+	}
+}
+
+func TestSessionRegistryEvictsOldest(t *testing.T) {
+	registry := NewSessionRegistry[string](0, 2)
+	first, second, third := new(mcp.ClientSession), new(mcp.ClientSession), new(mcp.ClientSession)
+	registry.Set(first, "first")
+	time.Sleep(time.Millisecond)
+	registry.Set(second, "second")
+	time.Sleep(time.Millisecond)
+	registry.Get(first)
+	registry.Set(third, "third")
+
+	if _, ok := registry.Get(second); ok {
+		t.Error("kept the least recently used session beyond maxSessions")
+	}
+	if _, ok := registry.Get(first); !ok {
+		t.Error("evicted a recently used session")
+	}
+}
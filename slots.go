@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"maps"
+)
+
+// Slot keys of the light attributes accepted by DeviceControl.
+const (
+	SlotOnOff      = "on_off"
+	SlotBrightness = "brightness"
+	SlotColorTemp  = "color_temperature"
+	SlotColor      = "color"
+)
+
+// Supported color temperature range of lights, in kelvin.
+const (
+	MinColorTempKelvin = 2700
+	MaxColorTempKelvin = 6500
+)
+
+// OnOffSlot returns the slot turning devices on or off.
+func OnOffSlot(on bool) map[string]any {
+	value := "off"
+	if on {
+		value = "on"
+	}
+	return map[string]any{SlotOnOff: value}
+}
+
+// BrightnessSlot returns the slot setting the brightness in percent, from 0 to 100.
+func BrightnessSlot(pct int) (map[string]any, error) {
+	if pct < 0 || pct > 100 {
+		return nil, errors.New(tr("brightness %d out of range 0-100", pct))
+	}
+	return map[string]any{SlotBrightness: pct}, nil
+}
+
+// ColorTempSlot returns the slot setting the color temperature in kelvin,
+// from MinColorTempKelvin to MaxColorTempKelvin.
+func ColorTempSlot(kelvin int) (map[string]any, error) {
+	if kelvin < MinColorTempKelvin || kelvin > MaxColorTempKelvin {
+		return nil, errors.New(tr("color temperature %dK out of range %d-%dK", kelvin, MinColorTempKelvin, MaxColorTempKelvin))
+	}
+	return map[string]any{SlotColorTemp: kelvin}, nil
+}
+
+// RGBSlot returns the slot setting the color.
+func RGBSlot(r, g, b uint8) map[string]any {
+	return map[string]any{SlotColor: map[string]any{"r": r, "g": g, "b": b}}
+}
+
+// mergeSlots merges slots into a single control parameters map.
+func mergeSlots(slots ...map[string]any) map[string]any {
+	merged := make(map[string]any)
+	for _, slot := range slots {
+		maps.Copy(merged, slot)
+	}
+	return merged
+}
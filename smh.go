@@ -2,21 +2,33 @@ package main
 
 import (
 	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
+	mrand "math/rand/v2"
+	"net"
 	"net/http"
 	"github.com/devfans/golang/log"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // ---------- Structs ----------
@@ -42,6 +54,7 @@ type RequestBody struct {
 	Params    any    `json:"params"`
 	DeviceID  string `json:"device_id"`
 	RequestID string `json:"request_id"`
+	Region    string `json:"region,omitempty"`
 }
 
 // RespBody is a generic API response structure.
@@ -50,180 +63,534 @@ type RespBody[T any] struct {
 	Message    string `json:"message"`
 	Result     T      `json:"result"`
 	MsgDetails string `json:"msgDetails"`
+	// RetryAfter is the backend's hint in seconds before retrying a throttled request.
+	RetryAfter int `json:"retryAfter,omitempty"`
+}
+
+// SupportedRegions lists the region codes accepted by Login, append to it to support new regions.
+var SupportedRegions = []string{"CN", "US", "EU", "KR"}
+
+// ---------- Token State ----------
+
+var (
+	tokenMu     sync.RWMutex
+	loginToken  string
+	loginRegion string
+)
+
+// setLoginToken stores the token obtained by Login outside of a session, an empty token clears it.
+func setLoginToken(token, region string) {
+	tokenMu.Lock()
+	loginToken = token
+	loginRegion = region
+	tokenMu.Unlock()
+}
+
+// storeLogin stores the token obtained by Login for the session of ctx, or globally outside of a session.
+func storeLogin(ctx context.Context, token, region string) {
+	if session := sessionFromContext(ctx); session != nil {
+		Sessions.Set(session, sessionCredentials{Token: token, Region: region})
+		return
+	}
+	setLoginToken(token, region)
+}
+
+// clearLogin drops the token of the session of ctx if it logged in, otherwise the global one.
+func clearLogin(ctx context.Context) {
+	if session := sessionFromContext(ctx); session != nil {
+		if _, ok := Sessions.Get(session); ok {
+			Sessions.Delete(session)
+			return
+		}
+	}
+	setLoginToken("", "")
+}
+
+// currentToken returns the token the session of ctx logged in with, falling back to the
+// token obtained by Login outside of a session and then to API_KEY.
+func currentToken(ctx context.Context) string {
+	if creds, ok := Sessions.Get(sessionFromContext(ctx)); ok {
+		return creds.Token
+	}
+	tokenMu.RLock()
+	defer tokenMu.RUnlock()
+	if loginToken != "" {
+		return loginToken
+	}
+	return API_KEY
+}
+
+// currentRegion returns the region of the account currentToken belongs to, empty for API_KEY.
+func currentRegion(ctx context.Context) string {
+	if creds, ok := Sessions.Get(sessionFromContext(ctx)); ok {
+		return creds.Region
+	}
+	tokenMu.RLock()
+	defer tokenMu.RUnlock()
+	if loginToken != "" {
+		return loginRegion
+	}
+	return ""
+}
+
+// ---------- Errors ----------
+
+// ErrMissingSecret is returned instead of sending a request while the app secret could not be fetched.
+var ErrMissingSecret = errors.New("Server not initialized: missing app secret, it is being fetched again, please retry later.")
+
+// ErrReadOnly is returned instead of calling a mutating service while READ_ONLY is set.
+var ErrReadOnly = errors.New("Server in read-only mode: changing devices, scenes, scheduled tasks or the home is disabled.")
+
+// MutatingServices lists the services that change the home, refused while READ_ONLY is set.
+var MutatingServices = []string{"DeviceControl", "RunScenes", "AutomationConfig", "CancelAutomation", "SwitchHome"}
+
+// Well-known business codes reported by the backend.
+const (
+	CodeInvalidSignature = 103
+	CodeServerBusy       = 104
+	CodeTokenInvalid     = 106
+	CodeTokenExpired     = 108
+	CodeRateLimited      = 429
+)
+
+// APIError is a non-zero business code returned by the backend.
+//
+// Both texts of the response are kept: Message is the backend's short description and
+// Details its msgDetails, usually the more specific text but at times a stack trace.
+// Error picks the one fit for users.
+type APIError struct {
+	Code    int
+	Message string
+	Details string
+	// RetryAfter is how long the backend asked to wait before retrying, if it did.
+	RetryAfter time.Duration
+}
+
+// Error returns the text to show users: the details unless they are empty or look like a
+// stack trace, then the message, and the code alone if neither is usable.
+func (e *APIError) Error() string {
+	details := strings.TrimSpace(e.Details)
+	if details != "" && !isStackTrace(details) {
+		return details
+	}
+	if message := strings.TrimSpace(e.Message); message != "" {
+		return message
+	}
+	return fmt.Sprintf("Request failed with code %d", e.Code)
+}
+
+// isStackTrace reports whether text looks like a stack trace rather than a message.
+func isStackTrace(text string) bool {
+	if strings.Count(text, "\n") >= 2 {
+		return true
+	}
+	for _, marker := range []string{"Exception:", "Exception in thread", "Traceback (most recent call", "goroutine ", "\tat ", "at java.", "at com."} {
+		if strings.Contains(text, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// StatusError is a non-200 HTTP status returned by the backend.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("API call failed. status code: %d", e.StatusCode)
+}
+
+// TokenExpired reports whether the request token is expired or no longer valid.
+func (e *APIError) TokenExpired() bool {
+	return e.Code == CodeTokenExpired || e.Code == CodeTokenInvalid
+}
+
+// InvalidSignature reports whether the backend rejected the request signature.
+func (e *APIError) InvalidSignature() bool {
+	return e.Code == CodeInvalidSignature
+}
+
+// RateLimited reports whether the backend throttled the request.
+func (e *APIError) RateLimited() bool {
+	return e.Code == CodeRateLimited
+}
+
+// Retryable reports whether the request may succeed if sent again, as configured by RETRY_CODES.
+func (e *APIError) Retryable() bool {
+	return RETRY_CODES[e.Code]
+}
+
+// defaultRetryCodes are the business codes retried unless RETRY_CODES says otherwise.
+var defaultRetryCodes = map[int]bool{
+	CodeServerBusy:  true,
+	CodeRateLimited: true,
+}
+
+// parseRetryCodes reads a comma-separated list of "code:true" or "code:false" entries,
+// a bare "code" meaning true, on top of defaultRetryCodes. Invalid entries are skipped.
+func parseRetryCodes(value string) map[int]bool {
+	codes := maps.Clone(defaultRetryCodes)
+	for _, entry := range parseList(value) {
+		code, retry, hasRetry := strings.Cut(entry, ":")
+		n, err := strconv.Atoi(strings.TrimSpace(code))
+		retryable := true
+		if err == nil && hasRetry {
+			retryable, err = strconv.ParseBool(strings.TrimSpace(retry))
+		}
+		if err != nil {
+			log.Error("Invalid RETRY_CODES entry, skipping", "entry", entry, "err", err)
+			continue
+		}
+		codes[n] = retryable
+	}
+	return codes
 }
 
 // ---------- API Wrappers ----------
 
 // Login authenticates a user and returns the login result and error message, if any.
-func Login(username, password, region string) (*LoginResult, string) {
+// An empty region falls back to DEFAULT_REGION.
+func Login(ctx context.Context, username, password, region string) (*LoginResult, string) {
 	if strings.TrimSpace(username) == "" {
-		return nil, "Username cannot be empty"
+		return nil, tr("Username cannot be empty")
 	}
 	if strings.TrimSpace(password) == "" {
-		return nil, "Password cannot be empty"
+		return nil, tr("Password cannot be empty")
+	}
+	if strings.TrimSpace(region) == "" {
+		region = DEFAULT_REGION
 	}
 	if strings.TrimSpace(region) == "" {
-		return nil, "Region cannot be empty"
+		return nil, tr("Region cannot be empty")
+	}
+	region = strings.ToUpper(strings.TrimSpace(region))
+	if !slices.Contains(SupportedRegions, region) {
+		return nil, tr("Unsupported region %q, valid options: %s", region, strings.Join(SupportedRegions, ", "))
 	}
 
-	result, err := CallService[LoginResult]("Login", struct {
+	result, err := CallService[LoginResult](ctx, "Login", struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
 		Region   string `json:"region"`
 	}{
 		Username: strings.TrimSpace(username),
 		Password: strings.TrimSpace(password),
-		Region:   strings.ToUpper(strings.TrimSpace(region)),
+		Region:   region,
 	})
-	return result, err
+	if err != nil {
+		return nil, err.Error()
+	}
+	if result.Token != "" {
+		if result.Region == "" {
+			result.Region = region
+		}
+		storeLogin(ctx, result.Token, result.Region)
+	}
+	return result, ""
+}
+
+// Logout invalidates the current login token on the backend and clears it locally.
+func Logout(ctx context.Context) string {
+	_, err := CallService[any](ctx, "Logout", nil)
+	// Drop the local token even if the backend call failed, so it is not reused.
+	clearLogin(ctx)
+	if err != nil {
+		return err.Error()
+	}
+	return tr("Logout successful")
 }
 
 // DeviceControl sends a device control command.
-func DeviceControl(devices []int, slots map[string]any) string {
+//
+// If idempotencyKey is set it is sent as the request id so the backend can dedupe
+// repeated commands. A caller retrying after a timeout must reuse the original key,
+// since the first attempt may have been executed even though no response arrived.
+//
+// Batches of more than CONTROL_MAX_BATCH devices are rejected if CONTROL_BATCH_MODE is
+// "reject", otherwise they are sent in chunks of CONTROL_MAX_BATCH devices, each with the
+// idempotency key suffixed by its index, and the failed chunks are reported.
+func DeviceControl(ctx context.Context, devices []int, slots map[string]any, idempotencyKey string) string {
 	if len(devices) == 0 {
-		return "Device list cannot be empty"
+		return tr("Device list cannot be empty")
 	}
 	if len(slots) == 0 {
-		return "Control parameters cannot be empty"
+		return tr("Control parameters cannot be empty")
 	}
 
-	data := map[string]any{
-		"devices": devices,
-		"slots":   []map[string]any{slots},
-	}
-	_, message := CallService[string]("DeviceControl", data)
-	if message != "" {
-		return message
+	limit := int(CONTROL_MAX_BATCH)
+	if limit <= 0 || len(devices) <= limit {
+		result, err := deviceControl(ctx, devices, slots, idempotencyKey)
+		if err != nil {
+			return err.Error()
+		}
+		return result
+	}
+	if strings.EqualFold(CONTROL_BATCH_MODE, "reject") {
+		return tr("Too many devices: %d, at most %d per call", len(devices), limit)
+	}
+	log.Info("Controlling devices in chunks", "devices", len(devices), "chunk_size", limit)
+	var results, failures []string
+	for i, chunk := 0, 0; i < len(devices); i, chunk = i+limit, chunk+1 {
+		batch := devices[i:min(i+limit, len(devices))]
+		key := idempotencyKey
+		if key != "" {
+			key = fmt.Sprintf("%s-%d", idempotencyKey, chunk)
+		}
+		result, err := deviceControl(ctx, batch, slots, key)
+		if errors.Is(err, ErrReadOnly) {
+			// Every chunk is refused alike, report it once.
+			return err.Error()
+		}
+		if err != nil {
+			failures = append(failures, tr("Devices %v: %s", batch, err.Error()))
+			continue
+		}
+		results = append(results, result)
 	}
-	return "Device control success"
-}
-
-// DeviceQuery queries the device list by positions and types.
-func DeviceQuery(positions []string, types []string) string {
-	if positions == nil {
-		positions = []string{}
+	if len(failures) > 0 {
+		return tr("Device control failed for some devices:") + "\n" + strings.Join(failures, "\n")
 	}
-	if types == nil {
-		types = []string{}
+	if DRY_RUN {
+		// Each chunk reports the payload it would have sent.
+		return strings.Join(results, "\n")
 	}
+	return tr("Device control success")
+}
 
+// deviceControl sends a single DeviceControl call for devices and returns the result message,
+// or the error of the call.
+func deviceControl(ctx context.Context, devices []int, slots map[string]any, idempotencyKey string) (string, error) {
 	data := map[string]any{
-		"positions":    positions,
-		"device_types": types,
+		"devices": devices,
+		"slots":   []map[string]any{slots},
 	}
-	result, message := CallService[string]("DeviceQuery", data)
-	if message != "" {
-		return message
+	if DRY_RUN {
+		return dryRun("DeviceControl", data), nil
 	}
-	if result == nil {
-		return "No device data available"
+	if _, err := CallServiceWithID[string](ctx, "DeviceControl", idempotencyKey, data); err != nil {
+		return "", err
 	}
-	return *result
+	return tr("Device control success"), nil
 }
 
-// DeviceStatusQuery fetches device status information.
-func DeviceStatusQuery(positions []string, types []string) string {
-	if positions == nil {
-		positions = []string{}
+// DeviceQuery queries the device list by positions and types, see queryFilter for the
+// defaults applied to empty ones.
+func DeviceQuery(ctx context.Context, positions []string, types []string) string {
+	result, err := queryDevices(ctx, "DeviceQuery", queryFilter(positions, DEFAULT_POSITIONS), queryFilter(types, DEFAULT_DEVICE_TYPES))
+	if err != nil {
+		return err.Error()
 	}
-	if types == nil {
-		types = []string{}
+	if result == "" {
+		return tr("No device data available")
 	}
+	return result
+}
 
-	data := map[string]any{
-		"positions":    positions,
-		"device_types": types,
-	}
-	result, message := CallService[string]("DeviceStatusQuery", data)
-	if message != "" {
-		return message
+// DeviceStatusQuery fetches device status information, see queryFilter for the defaults
+// applied to empty positions and types.
+func DeviceStatusQuery(ctx context.Context, positions []string, types []string) string {
+	result, err := queryDevices(ctx, "DeviceStatusQuery", queryFilter(positions, DEFAULT_POSITIONS), queryFilter(types, DEFAULT_DEVICE_TYPES))
+	if err != nil {
+		return err.Error()
 	}
-	if result == nil {
-		return "No device status data available"
+	if result == "" {
+		return tr("No device status data available")
 	}
-	return *result
+	return result
 }
 
 // GetScenes queries automation scenes for specified positions.
-func GetScenes(positions []string) string {
-	if positions == nil {
-		positions = []string{}
-	}
-
-	data := map[string]any{
-		"positions": positions,
-	}
-	result, message := CallService[string]("GetScenes", data)
-	if message != "" {
-		return message
+func GetScenes(ctx context.Context, positions []string) string {
+	result, err := queryScenes(ctx, positions)
+	if err != nil {
+		return err.Error()
 	}
-	if result == nil {
-		return "No scenes available"
+	if result == "" {
+		return tr("No scenes available")
 	}
-	return *result
+	return result
+}
+
+// queryDevices calls DeviceQuery or DeviceStatusQuery for exactly the positions and types
+// given, all of them if empty, and returns the Markdown result.
+func queryDevices(ctx context.Context, serviceName string, positions []string, types []string) (string, error) {
+	return queryText(ctx, serviceName, map[string]any{
+		"positions":    orEmpty(positions),
+		"device_types": orEmpty(types),
+	})
+}
+
+// queryScenes calls GetScenes for positions and returns the Markdown result.
+func queryScenes(ctx context.Context, positions []string) (string, error) {
+	return queryText(ctx, "GetScenes", map[string]any{
+		"positions": orEmpty(positions),
+	})
+}
+
+// queryText calls a query service and returns its result text, the encoded JSON if the
+// result is not a string, or empty if there is none.
+func queryText(ctx context.Context, serviceName string, data any) (string, error) {
+	result, err := CallService[json.RawMessage](ctx, serviceName, data)
+	if err != nil || result == nil {
+		return "", err
+	}
+	var text string
+	if err := json.Unmarshal(*result, &text); err == nil {
+		return text, nil
+	}
+	return string(*result), nil
+}
+
+// sceneResult is the outcome of a single scene reported by RunScenes.
+type sceneResult struct {
+	Scene   int    `json:"scene"`
+	ID      int    `json:"id"`
+	Success *bool  `json:"success"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
 }
 
 // RunScenes executes the specified scenes.
-func RunScenes(scenes []int) string {
+//
+// If the backend reports per-scene results, the succeeded and failed scenes are listed,
+// a message returned instead is passed on in place of the generic success message.
+func RunScenes(ctx context.Context, scenes []int) string {
 	if len(scenes) == 0 {
-		return "Scene list cannot be empty"
+		return tr("Scene list cannot be empty")
 	}
 
 	data := map[string]any{
 		"scenes": scenes,
 	}
-	_, message := CallService[any]("RunScenes", data)
-	if message != "" {
-		return message
+	if DRY_RUN {
+		return dryRun("RunScenes", data)
 	}
-	return "Scene executed successfully"
+	raw, err := CallServiceRaw(ctx, "RunScenes", data)
+	if err != nil {
+		return err.Error()
+	}
+	return sceneResults(raw)
+}
+
+// sceneResults describes the result of RunScenes, falling back to the generic success
+// message if it is neither a list of scene results nor a message.
+func sceneResults(raw json.RawMessage) string {
+	var message string
+	if json.Unmarshal(raw, &message) == nil && strings.TrimSpace(message) != "" {
+		return strings.TrimSpace(message)
+	}
+	var results []sceneResult
+	if json.Unmarshal(raw, &results) != nil || len(results) == 0 {
+		return tr("Scene executed successfully")
+	}
+	var succeeded, failed []string
+	for _, r := range results {
+		id := cmp.Or(r.Scene, r.ID)
+		if (r.Success != nil && *r.Success) || (r.Success == nil && r.Code == 0) {
+			succeeded = append(succeeded, strconv.Itoa(id))
+			continue
+		}
+		failure := strconv.Itoa(id)
+		if r.Message != "" {
+			failure += " (" + r.Message + ")"
+		}
+		failed = append(failed, failure)
+	}
+	if len(failed) == 0 {
+		return tr("Scene executed successfully")
+	}
+	lines := []string{tr("Buttons failed: %s", strings.Join(failed, ", "))}
+	if len(succeeded) > 0 {
+		lines = append(lines, tr("Buttons succeeded: %s", strings.Join(succeeded, ", ")))
+	}
+	return strings.Join(lines, "\n")
 }
 
 // GetHomes retrieves the list of user homes.
-func GetHomes() ([]string, string) {
-	result, err := CallService[[]string]("GetHomes", nil)
-	if err != "" {
-		return nil, err
+func GetHomes(ctx context.Context) ([]string, string) {
+	result, err := CallService[[]string](ctx, "GetHomes", nil)
+	if err != nil {
+		return nil, err.Error()
 	}
 	if result == nil {
-		return nil, "No homes available"
+		return nil, tr("No homes available")
 	}
 	return *result, ""
 }
 
-// SwitchHome switches the current user home.
-func SwitchHome(homeName string) (bool, string) {
+// GetCurrentHome returns the name of the user's active home, the one device and scene
+// calls act on.
+func GetCurrentHome(ctx context.Context) (string, string) {
+	result, err := CallService[string](ctx, "GetCurrentHome", nil)
+	if err != nil {
+		return "", err.Error()
+	}
+	if result == nil || strings.TrimSpace(*result) == "" {
+		return "", tr("No current home")
+	}
+	rememberHome(ctx, strings.TrimSpace(*result))
+	return strings.TrimSpace(*result), ""
+}
+
+// SwitchHome switches the current user home, optionally restricted to a region,
+// and purges the cached device and button queries.
+func SwitchHome(ctx context.Context, homeName, region string) (bool, string) {
 	if strings.TrimSpace(homeName) == "" {
-		return false, "Home name cannot be empty"
+		return false, tr("Home name cannot be empty")
 	}
 
-	result, message := CallService[string]("SwitchHome", struct {
+	result, err := CallService[string](ctx, "SwitchHome", struct {
 		HomeName string `json:"home_name"`
+		Region   string `json:"region,omitempty"`
 	}{
 		HomeName: strings.TrimSpace(homeName),
+		Region:   strings.ToUpper(strings.TrimSpace(region)),
 	})
-	if message != "" {
-		return false, message
+	// Devices and buttons cached for the previous home must not be served for the new one,
+	// purge even on failure as the current home is then unknown.
+	PurgeQueryCache()
+	if err != nil {
+		return false, err.Error()
 	}
 	if result == nil {
-		return false, "Home switch failed: no response from server"
+		return false, tr("Home switch failed: no response from server")
 	}
+	rememberHome(ctx, strings.TrimSpace(homeName))
 	return true, ""
 }
 
 // AutomationConfig configures a scheduled device control task.
-func AutomationConfig(scheduledTime string, endpointIDs []int, controlParams map[string]any, taskName string, executionOnce bool) string {
+//
+// idempotencyKey behaves as in DeviceControl, preventing duplicated tasks on retries.
+func AutomationConfig(ctx context.Context, scheduledTime string, endpointIDs []int, controlParams map[string]any, taskName string, executionOnce bool, idempotencyKey, timeZone string) string {
 	if strings.TrimSpace(scheduledTime) == "" {
-		return "Scheduled time cannot be empty"
+		return tr("Scheduled time cannot be empty")
+	}
+	if err := validateSchedule(scheduledTime, executionOnce); err != nil {
+		return tr("Invalid scheduled time %q: %v", scheduledTime, err)
+	}
+	var converted string
+	if strings.TrimSpace(timeZone) != "" {
+		from, err := parseZone(timeZone)
+		if err != nil {
+			return tr("Invalid time zone %q: %v", timeZone, err)
+		}
+		converted, err = convertSchedule(scheduledTime, from, time.Now())
+		if err != nil {
+			return tr("Invalid scheduled time %q: %v", scheduledTime, err)
+		}
+		log.Info("Converted schedule to home time zone", "scheduled_time", scheduledTime, "from", timeZone, "to", HOME_TIME_ZONE, "converted", converted)
+		scheduledTime = converted
 	}
 	if len(endpointIDs) == 0 {
-		return "Device list cannot be empty"
+		return tr("Device list cannot be empty")
 	}
 	if len(controlParams) == 0 {
-		return "Control parameters cannot be empty"
+		return tr("Control parameters cannot be empty")
 	}
 	if strings.TrimSpace(taskName) == "" {
-		return "Task name cannot be empty"
+		return tr("Task name cannot be empty")
 	}
 
 	data := map[string]any{
@@ -234,30 +601,80 @@ func AutomationConfig(scheduledTime string, endpointIDs []int, controlParams map
 		"execution_once": executionOnce,
 	}
 
-	_, message := CallService[string]("AutomationConfig", data)
-	if message != "" {
-		return message
+	if DRY_RUN {
+		return dryRun("AutomationConfig", data)
+	}
+	_, err := CallServiceWithID[string](ctx, "AutomationConfig", idempotencyKey, data)
+	if err != nil {
+		return err.Error()
+	}
+	if converted != "" {
+		return tr("Automation configuration successful") + "\n" + tr("Scheduled as %q in time zone %s", converted, HOME_TIME_ZONE)
+	}
+	return tr("Automation configuration successful")
+}
+
+// ListAutomations lists the scheduled tasks under the current home.
+func ListAutomations(ctx context.Context) string {
+	result, err := CallService[string](ctx, "ListAutomations", nil)
+	if err != nil {
+		return err.Error()
+	}
+	if result == nil || strings.TrimSpace(*result) == "" {
+		return tr("No scheduled tasks found")
+	}
+	return *result
+}
+
+// CancelAutomation cancels the scheduled task with the given id.
+func CancelAutomation(ctx context.Context, taskID string) string {
+	taskID = strings.TrimSpace(taskID)
+	if taskID == "" {
+		return tr("Task id cannot be empty")
+	}
+
+	data := map[string]any{
+		"task_id": taskID,
+	}
+	if DRY_RUN {
+		return dryRun("CancelAutomation", data)
+	}
+	_, err := CallService[any](ctx, "CancelAutomation", data)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		// Unknown task ids are reported as business errors, tell which task failed.
+		return tr("Failed to cancel task %q: %s", taskID, apiErr.Error())
 	}
-	return "Automation configuration successful"
+	if err != nil {
+		return err.Error()
+	}
+	return tr("Task %q cancelled", taskID)
 }
 
 // DeviceLogQuery queries device historical log information
-func DeviceLogQuery(endpointIDs []int, startDatetime, endDatetime string, attributes []string) string {
-	log.Info("[INFO] [DeviceLogQuery] Querying device logs for endpoints: %v, start: %s, end: %s, attributes: %v",
-		endpointIDs, startDatetime, endDatetime, attributes)
+//
+// Times are normalized into the home time zone, see normalizeLogTime.
+//
+// A positive limit returns at most limit logs starting at offset, with a hint to fetch the next
+// page appended when the page is full.
+func DeviceLogQuery(ctx context.Context, endpointIDs []int, startDatetime, endDatetime string, attributes []string, limit, offset int) string {
+	log.Info("Querying device logs", "endpoints", endpointIDs, "start", startDatetime, "end", endDatetime, "attributes", attributes, "limit", limit, "offset", offset)
 
 	if len(endpointIDs) == 0 {
-		return "Device list cannot be empty"
+		return tr("Device list cannot be empty")
 	}
 
 	timeSpan := make([]string, 0)
 
 	// Add optional parameters if provided
-	if strings.TrimSpace(startDatetime) != "" {
-		timeSpan = append(timeSpan, strings.TrimSpace(startDatetime))
-	}
-	if strings.TrimSpace(endDatetime) != "" {
-		timeSpan = append(timeSpan, strings.TrimSpace(endDatetime))
+	for _, value := range []string{startDatetime, endDatetime} {
+		normalized, err := normalizeLogTime(value)
+		if err != nil {
+			return tr("Invalid time %q: %v", value, err)
+		}
+		if normalized != "" {
+			timeSpan = append(timeSpan, normalized)
+		}
 	}
 
 	data := map[string]any{
@@ -268,119 +685,436 @@ func DeviceLogQuery(endpointIDs []int, startDatetime, endDatetime string, attrib
 	if len(attributes) > 0 {
 		data["attributes"] = attributes
 	}
+	if limit > 0 {
+		data["limit"] = limit
+		data["offset"] = max(offset, 0)
+	}
 
-	result, message := CallService[string]("DeviceLogQuery", data)
-	if message != "" {
-		return message
+	result, err := CallService[string](ctx, "DeviceLogQuery", data)
+	if err != nil {
+		return err.Error()
 	}
 	if result == nil {
-		return "No device log data available"
+		return tr("No device log data available")
+	}
+	if limit > 0 && countTableRows(*result) >= limit {
+		return *result + "\n" + tr("More logs may follow, next offset %d", max(offset, 0)+limit)
 	}
 	return *result
 }
 
-// CallService calls the specific service with payload and returns parsed result and error message.
-func CallService[T any](serviceName string, data any) (*T, string) {
-	requestURL := API_BASE_URL + "/call"
+// countTableRows counts the data rows of the Markdown tables in text.
+func countTableRows(text string) int {
+	rows := 0
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "|") {
+			continue
+		}
+		if strings.Trim(line, "|-: ") == "" {
+			// A separator row, not counting it nor the header row above it.
+			rows--
+			continue
+		}
+		rows++
+	}
+	return max(rows, 0)
+}
+
+
+// Doer sends HTTP requests, as *http.Client does. Upstream requests go through it so a
+// stub returning canned responses can stand in for the cloud service.
+type Doer interface {
+	Do(request *http.Request) (*http.Response, error)
+}
+
+// httpClient is shared by all upstream requests, so keep-alive connections are pooled
+// and reused instead of paying a TLS handshake per call.
+var httpClient Doer = newHTTPClient()
+
+// SetHTTPClient replaces the client of upstream requests with client and returns a function
+// restoring the previous one.
+func SetHTTPClient(client Doer) (restore func()) {
+	previous := httpClient
+	httpClient = client
+	return func() { httpClient = previous }
+}
+
+// upstreamProxy returns the proxy of upstream requests: API_PROXY when set, otherwise the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment, which also picks them up from .env.
+func upstreamProxy(proxy string) func(*http.Request) (*url.URL, error) {
+	if proxy == "" {
+		return http.ProxyFromEnvironment
+	}
+	proxyURL, err := url.Parse(proxy)
+	if err != nil || proxyURL.Host == "" {
+		log.Error("Invalid API_PROXY, using the proxy environment", "value", proxy, "err", err)
+		return http.ProxyFromEnvironment
+	}
+	log.Info("Upstream requests go through proxy", "proxy", proxyURL.Redacted())
+	return http.ProxyURL(proxyURL)
+}
+
+// newHTTPClient creates the upstream client with the configured overall, dial, TLS handshake
+// and response header timeouts, and a connection pool sized by API_MAX_IDLE_CONNS_PER_HOST.
+func newHTTPClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   API_DIAL_TIMEOUT,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Client{
+		Timeout: API_TIMEOUT,
+		Transport: &http.Transport{
+			Proxy:                 upstreamProxy(API_PROXY),
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   API_TLS_HANDSHAKE_TIMEOUT,
+			ResponseHeaderTimeout: API_RESPONSE_HEADER_TIMEOUT,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   int(API_MAX_IDLE_CONNS_PER_HOST),
+			IdleConnTimeout:       90 * time.Second,
+		},
+	}
+}
+
+// CallService calls the specific service with payload and returns parsed result or error.
+// Results of the cachedServices are served from queryCache while fresh.
+// Backend failures are returned as *APIError.
+func CallService[T any](ctx context.Context, serviceName string, data any) (*T, error) {
+	key, cacheable := queryCacheKey(currentToken(ctx), serviceName, data)
+	if cacheable {
+		if cached, ok := queryCache.Get(key); ok {
+			if result, ok := cached.(*T); ok {
+				log.Debug("Serving cached result", "service", serviceName)
+				return result, nil
+			}
+		}
+	}
+	result, err := CallServiceWithID[T](ctx, serviceName, "", data)
+	if cacheable && err == nil {
+		queryCache.Set(key, result)
+	}
+	return result, err
+}
+
+// CallServiceRaw calls the specific service and returns its result as raw JSON, for callers that
+// post-process the structured payload. A JSON document encoded as a string result is unwrapped.
+func CallServiceRaw(ctx context.Context, serviceName string, data any) (json.RawMessage, error) {
+	result, err := CallService[json.RawMessage](ctx, serviceName, data)
+	if err != nil || result == nil {
+		return nil, err
+	}
+	raw := *result
+	var text string
+	if json.Unmarshal(raw, &text) == nil && json.Valid([]byte(text)) {
+		raw = json.RawMessage(text)
+	}
+	return raw, nil
+}
+
+// CallServiceWithID calls the service like CallService, using requestID as the request id
+// so the backend can dedupe repeated calls. The id is derived from the tool invocation of ctx
+// if requestID is empty.
+func CallServiceWithID[T any](ctx context.Context, serviceName, requestID string, data any) (_ *T, err error) {
+	defer func() { recordCallError(ctx, err) }()
+	if READ_ONLY && slices.Contains(MutatingServices, serviceName) {
+		log.Warn("Refused mutating call in read-only mode", "service", serviceName)
+		return nil, ErrReadOnly
+	}
+	if requestID == "" {
+		requestID = nextRequestID(ctx)
+	}
+	requestURL := apiURL(API_CALL_PATH)
 	reqData := RequestBody{
-		Token:     API_KEY,
+		Token:     currentToken(ctx),
 		Version:   Version,
 		Fn:        serviceName,
 		Params:    data,
 		DeviceID:  DeviceID,
-		RequestID: strings.Replace(uuid.NewString(), "-", "", -1),
+		RequestID: requestID,
+		Region:    currentRegion(ctx),
+	}
+	result, err := Post[T](ctx, requestURL, serviceName, reqData)
+	if err != nil {
+		log.Warn("Service call failed", "service", serviceName, "request_id", requestID, "correlation_id", correlationIDFromContext(ctx), "err", err)
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.TokenExpired() {
+		// A token obtained by Login is no longer usable, fall back to API_KEY for later calls.
+		log.Warn("Login token expired", "service", serviceName, "code", apiErr.Code)
+		if _, ok := Sessions.Get(sessionFromContext(ctx)); ok {
+			// The session logged in to its own account, it has to log in again.
+			clearLogin(ctx)
+			return result, err
+		}
+		setLoginToken("", "")
+		// Re-login and retry the call once, never for Login itself to avoid looping.
+		if serviceName != "Login" && relogin(ctx) {
+			reqData.Token = currentToken(ctx)
+			reqData.Region = currentRegion(ctx)
+			return Post[T](ctx, requestURL, serviceName, reqData)
+		}
 	}
-	return Post[T](requestURL, serviceName, reqData)
+	return result, err
+}
+
+// dryRun logs the payload a control call would send in DRY_RUN mode and returns a message saying it was not sent.
+func dryRun(serviceName string, data any) string {
+	payload, _ := json.Marshal(data)
+	log.Info("Dry run, skipping API call", "service", serviceName, "payload", string(payload))
+	return tr("[DRY RUN] %s was not sent, payload: %s", serviceName, string(payload))
+}
+
+// relogin logs in again with the LOGIN_* credentials and reports whether it succeeded.
+func relogin(ctx context.Context) bool {
+	if LOGIN_USERNAME == "" || LOGIN_PASSWORD == "" {
+		return false
+	}
+	log.Info("Re-login with configured credentials", "username", LOGIN_USERNAME, "region", LOGIN_REGION)
+	// The configured account is shared by all sessions, store its token globally.
+	ctx = withSession(ctx, nil)
+	if _, message := Login(ctx, LOGIN_USERNAME, LOGIN_PASSWORD, LOGIN_REGION); message != "" {
+		log.Error("Re-login failed", "username", LOGIN_USERNAME, "message", message)
+		return false
+	}
+	return true
+}
+
+// apiURL returns the URL of the API endpoint at path under API_BASE_URL.
+func apiURL(path string) string {
+	return strings.TrimRight(API_BASE_URL, "/") + "/" + strings.TrimLeft(path, "/")
 }
 
 // GetHeader returns the default headers for API requests.
 func GetHeader() map[string]string {
 	return map[string]string{
-		"app_lang":     "",
-		"lang":         "",
-		"app_id":       "",
-		"time_zone":    "",
-		"Content-Type": "application/json",
+		"app_lang":        HEADER_APP_LANG,
+		"lang":            HEADER_LANG,
+		"app_id":          HEADER_APP_ID,
+		"time_zone":       HEADER_TIME_ZONE,
+		"Content-Type":    "application/json",
+		"User-Agent":      USER_AGENT,
+		"Accept-Encoding": "gzip",
 	}
 }
 
-// Post sends a POST request and returns the decoded response or error message.
-func Post[T any](url string, serviceName string, body any) (*T, string) {
-	headers := GetHeader()
-	response, message := httpPost[T](url, body, headers)
-	if message != "" {
-		return nil, message
+// upstreamSlots bounds the number of in-flight upstream service calls.
+var upstreamSlots = make(chan struct{}, max(1, API_MAX_CONCURRENCY))
+
+// Post sends a POST request and returns the decoded response or error.
+//
+// At most API_MAX_CONCURRENCY posts are in flight at once, excess callers wait for a
+// slot until their context is done. While upstreamBreaker is open, posts fail fast with
+// ErrCircuitOpen.
+func Post[T any](ctx context.Context, url string, serviceName string, body any) (_ *T, err error) {
+	select {
+	case upstreamSlots <- struct{}{}:
+		defer func() { <-upstreamSlots }()
+	case <-ctx.Done():
+		return nil, fmt.Errorf("Request cancelled while waiting for an upstream slot: %w", ctx.Err())
+	}
+	if err := upstreamBreaker.Allow(); err != nil {
+		log.Warn("Upstream circuit open, failing fast", "service", serviceName)
+		return nil, err
 	}
-	return response, ""
+	defer func() { upstreamBreaker.Record(upstreamOutcome(err)) }()
+	defer trackProgress(ctx, serviceName, PROGRESS_INTERVAL)()
+	headers := GetHeader()
+	if id := correlationIDFromContext(ctx); id != "" {
+		headers[CorrelationHeader] = id
+	}
+	ctx, span := startUpstreamSpan(ctx, "upstream "+serviceName,
+		attribute.String("yalla.service", serviceName),
+		attribute.String("url.full", url),
+	)
+	start := time.Now()
+	result, err := httpPost[T](ctx, url, body, headers)
+	observeUpstream(serviceName, err != nil, time.Since(start))
+	endUpstreamSpan(span, err)
+	return result, err
 }
 
 // httpPost executes a HTTP POST with necessary signing and returns the parsed result.
-func httpPost[T any](url string, data any, headers map[string]string) (*T, string) {
+//
+// Connection errors, 5xx responses and throttled requests, either HTTP 429 or the
+// rate limit business code, are retried up to API_RETRIES times with exponential
+// backoff, waiting as long as the backend asks to through Retry-After instead when it
+// does. A retry that would wait longer than API_RETRY_MAX_WAIT in total is given up.
+// Other 4xx responses are returned as is. A non-zero business code is returned as *APIError.
+func httpPost[T any](ctx context.Context, url string, data any, headers map[string]string) (*T, error) {
 	jsonData, err := json.Marshal(data)
 	if err != nil {
-		return nil, "Data format error (invalid JSON data). Please try again later."
+		return nil, errors.New("Data format error (invalid JSON data). Please try again later.")
+	}
+
+	refreshed := false
+	var waited time.Duration
+	// The resend after refreshing the secret does not count as an attempt, so it leaves
+	// the retries of throttled or failed requests intact.
+	for attempt := 0; ; {
+		statusCode, body, retryAfter, err := sendPost(ctx, url, jsonData, headers)
+		if !refreshed && (statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden) {
+			// The signature may have been rejected due to a rotated secret, refresh it and resend once.
+			log.Warn("Signature rejected, refreshing app secret", "url", url, "status_code", statusCode)
+			refreshed = true
+			AppSecrets.Invalidate()
+			continue
+		}
+		retryable := err != nil || statusCode >= http.StatusInternalServerError || statusCode == http.StatusTooManyRequests
+		if !retryable {
+			result, err := decodeResponse[T](url, statusCode, body)
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				return result, err
+			}
+			if !refreshed && apiErr.InvalidSignature() {
+				log.Warn("Signature rejected, refreshing app secret", "url", url, "code", apiErr.Code)
+				refreshed = true
+				AppSecrets.Invalidate()
+				continue
+			}
+			if !apiErr.Retryable() {
+				return nil, err
+			}
+			retryAfter = apiErr.RetryAfter
+		}
+
+		delay := retryAfter
+		if delay <= 0 {
+			delay = retryBackoff(attempt)
+		}
+		if attempt >= int(API_RETRIES) || (API_RETRY_MAX_WAIT > 0 && waited+delay > API_RETRY_MAX_WAIT) {
+			if attempt < int(API_RETRIES) {
+				log.Warn("Giving up retrying API call, wait budget exhausted", "url", url, "waited", waited, "delay", delay)
+			}
+			if err != nil {
+				return nil, err
+			}
+			return decodeResponse[T](url, statusCode, body)
+		}
+		waited += delay
+		log.Warn("Retrying API call", "url", url, "attempt", attempt+1, "status_code", statusCode, "err", err, "delay", delay)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("Request cancelled: %w", ctx.Err())
+		case <-time.After(delay):
+		}
+		attempt++
+	}
+}
+
+// decodeResponse parses the response body of a completed POST into the result or error.
+func decodeResponse[T any](url string, statusCode int, body []byte) (*T, error) {
+	if statusCode != http.StatusOK {
+		log.Error("API call failed", "url", url, "status_code", statusCode, "response", string(body))
+		return nil, &StatusError{StatusCode: statusCode}
 	}
-	request, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+
+	var result = RespBody[T]{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		log.Error("JSON parsing failed", "err", err, "response", string(body))
+		if result.Message != "" {
+			return nil, errors.New(result.Message)
+		}
+		return nil, errors.New("The received data is not in a valid JSON format. Please try again later.")
+	}
+	if result.Code == 0 {
+		return &result.Result, nil
+	}
+
+	log.Warn("Request error", "code", result.Code, "message", result.Message, "details", result.MsgDetails)
+	return nil, &APIError{
+		Code:       result.Code,
+		Message:    result.Message,
+		Details:    result.MsgDetails,
+		RetryAfter: time.Duration(max(0, result.RetryAfter)) * time.Second,
+	}
+}
+
+// sendPost sends a single signed POST attempt and returns the status code, response body
+// and the wait asked for by a Retry-After header, if any.
+func sendPost(ctx context.Context, url string, jsonData []byte, headers map[string]string) (int, []byte, time.Duration, error) {
+	// The body reader is consumed by each send, so build a fresh request per attempt.
+	request, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(jsonData))
 	if err != nil {
-		return nil, "Failed to create HTTP request: invalid parameters or request body."
+		return 0, nil, 0, errors.New("Failed to create HTTP request: invalid parameters or request body.")
 	}
 	// Set request headers.
 	for key, value := range headers {
 		request.Header.Set(key, value)
 	}
-	// Add signature headers.
-	{
-		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
-		bodyHash, _ := calculateSignatureRequestBodyHash(jsonData)
-		signature := calculateSignature(AppSecret, request.Method, request.URL.RequestURI(), timestamp, bodyHash)
-
-		request.Header.Add(RequestSignatureHeaderAccessKey, AppID)
-		request.Header.Add(RequestSignatureHeaderTimestamp, timestamp)
-		request.Header.Add(RequestSignatureHeaderNonce, generateNonce(16))
-		request.Header.Add(RequestSignatureHeaderSignature, signature)
-	}
-
-	client := &http.Client{
-		Timeout: DefaultAPITimeout,
+	// Add signature headers, never sending a request signed with an empty secret.
+	secret := AppSecrets.Get(ctx)
+	if secret == "" {
+		// Get refetches an empty secret, so retrying the attempt refreshes it.
+		log.Warn("App secret unavailable, not sending unsigned request", "url", url)
+		return 0, nil, 0, ErrMissingSecret
 	}
+	signer := Signer{AccessKey: AppID, Secret: secret}
+	signer.Sign(request, jsonData, time.Now())
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(request.Header))
 
-	resp, err := client.Do(request)
+	resp, err := httpClient.Do(request)
 	if err != nil {
-		return nil, fmt.Sprintf("An error occurred while requesting the cloud service. %v", err)
+		return 0, nil, 0, fmt.Errorf("An error occurred while requesting the cloud service. %w", err)
 	}
 	defer resp.Body.Close()
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
 
-	body, err := io.ReadAll(resp.Body)
+	body, err := readBody(resp)
 	if err != nil {
-		return nil, fmt.Sprintf("Failed to read response: %v", err)
+		return resp.StatusCode, nil, retryAfter, fmt.Errorf("Failed to read response: %w", err)
 	}
+	return resp.StatusCode, body, retryAfter, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		log.Error("API call failed", "url", url, "status_code", resp.StatusCode, "response", string(body))
-		return nil, fmt.Sprintf("API call failed. status code: %d", resp.StatusCode)
+// readBody reads the response body, decompressing it if gzip encoded.
+//
+// Upstream requests ask for gzip explicitly, which turns off the transport's transparent
+// decompression, so a gzip body is always decoded here, also when sent unasked.
+func readBody(resp *http.Response) ([]byte, error) {
+	if resp.Uncompressed || !strings.EqualFold(strings.TrimSpace(resp.Header.Get("Content-Encoding")), "gzip") {
+		return io.ReadAll(resp.Body)
+	}
+	reader, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip response: %w", err)
 	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
 
-	var result = RespBody[T]{}
-	if err := json.Unmarshal(body, &result); err != nil {
-		log.Error("JSON parsing failed", "err", err, "response", string(body))
-		if result.Message != "" {
-			return nil, result.Message
-		}
-		return nil, "The received data is not in a valid JSON format. Please try again later."
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date,
+// returning zero if it is absent, invalid or already passed.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
 	}
-	if result.Code == 0 {
-		return &result.Result, ""
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(max(0, seconds)) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
 	}
+	return 0
+}
 
-	log.Warn("Request error", "code", result.Code, "details", result.MsgDetails)
-	if result.MsgDetails != "" {
-		return nil, result.MsgDetails
+// retryBackoff returns the delay before the next retry: exponential on the attempt with up to 50% jitter.
+func retryBackoff(attempt int) time.Duration {
+	delay := API_RETRY_DELAY << attempt
+	if delay <= 0 {
+		return 0
 	}
-	return nil, result.Message
+	return delay + time.Duration(mrand.Int64N(int64(delay)/2+1))
 }
 
 // httpGet executes an HTTP GET request and returns the parsed result.
-func httpGet[T any](baseURL string, queryParams map[string]string) (*T, error) {
+func httpGet[T any](ctx context.Context, baseURL string, queryParams map[string]string) (_ *T, err error) {
+	ctx, span := startUpstreamSpan(ctx, "upstream GET", attribute.String("url.full", baseURL))
+	defer func() { endUpstreamSpan(span, err) }()
+
 	parsedURL, err := url.Parse(baseURL)
 	if err != nil {
 		log.Error("Failed to parse base URL", "url", baseURL, "err", err)
@@ -396,18 +1130,26 @@ func httpGet[T any](baseURL string, queryParams map[string]string) (*T, error) {
 	}
 
 	finalURL := parsedURL.String()
-	resp, err := http.Get(finalURL)
+	request, err := http.NewRequestWithContext(ctx, "GET", finalURL, nil)
+	if err != nil {
+		log.Error("Failed to create GET request", "url", finalURL, "err", err)
+		return nil, fmt.Errorf("failed to create GET: %w", err)
+	}
+	request.Header.Set("User-Agent", USER_AGENT)
+	request.Header.Set("Accept-Encoding", "gzip")
+	resp, err := httpClient.Do(request)
 	if err != nil {
 		log.Error("Failed to send GET request", "url", finalURL, "err", err)
 		return nil, fmt.Errorf("failed to send GET: %w", err)
 	}
 	defer resp.Body.Close()
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
 
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("request to '%s' returned non-OK status: %d %s", finalURL, resp.StatusCode, resp.Status)
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	body, err := readBody(resp)
 	if err != nil {
 		log.Error("Failed to read response body", "url", finalURL, "err", err)
 		return nil, fmt.Errorf("failed to read response body: %w", err)
@@ -422,6 +1164,35 @@ func httpGet[T any](baseURL string, queryParams map[string]string) (*T, error) {
 	return &result, nil
 }
 
+// Signer signs upstream requests with HMAC-SHA256 of the app secret.
+//
+// The signed payload is "method\npath\ntimestamp\nbodyHash" joined by newlines, where
+// path is the request URI as returned by url.URL.RequestURI: the escaped path followed by
+// the raw query string if any (e.g. "/echo/mcp/call?x=1"), and bodyHash is the hex SHA256
+// of the request body. The query string is signed as sent, without reordering parameters.
+type Signer struct {
+	AccessKey string
+	Secret    string
+}
+
+// Sign adds the access key, timestamp, nonce and signature headers to the request.
+// Header names and the nonce length follow the SIGNATURE_* settings.
+func (s Signer) Sign(request *http.Request, body []byte, now time.Time) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	bodyHash, _ := calculateSignatureRequestBodyHash(body)
+	signature := s.Signature(request.Method, request.URL.RequestURI(), timestamp, bodyHash)
+
+	request.Header.Add(SIGNATURE_HEADER_ACCESS_KEY, s.AccessKey)
+	request.Header.Add(SIGNATURE_HEADER_TIMESTAMP, timestamp)
+	request.Header.Add(SIGNATURE_HEADER_NONCE, generateNonce(int(SIGNATURE_NONCE_LENGTH)))
+	request.Header.Add(SIGNATURE_HEADER_SIGNATURE, signature)
+}
+
+// Signature computes the signature for the request fields, empty if the secret is unset.
+func (s Signer) Signature(method, path, timestamp, bodyHash string) string {
+	return calculateSignature(s.Secret, method, path, timestamp, bodyHash)
+}
+
 // calculateSignature computes the signature for the request.
 func calculateSignature(secret, method, path, timestamp, bodyHash string) string {
 	if secret == "" {
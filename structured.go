@@ -0,0 +1,741 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devfans/golang/log"
+)
+
+// ---------- Structs ----------
+
+// Device represents a device with its attributes, current values for status queries.
+type Device struct {
+	ID         int            `json:"endpoint_id" jsonschema:"the device id"`
+	Name       string         `json:"device_name" jsonschema:"the device name"`
+	Position   string         `json:"position_name" jsonschema:"the position (room) of the device"`
+	Type       string         `json:"device_type" jsonschema:"the device type"`
+	Attributes map[string]any `json:"attributes,omitempty" jsonschema:"the device attributes, with their current values for status queries"`
+}
+
+// Scene represents a device control button (scene) under the home.
+type Scene struct {
+	ID       int    `json:"scene_id" jsonschema:"the control button id"`
+	Name     string `json:"scene_name" jsonschema:"the control button name"`
+	Position string `json:"position_name" jsonschema:"the position (room) of the control button"`
+}
+
+// DevicesOutput is the structured content of the device query tools.
+type DevicesOutput struct {
+	Devices []Device `json:"devices" jsonschema:"the devices found"`
+}
+
+// RoomsOutput is the structured content of the room query tool.
+type RoomsOutput struct {
+	Rooms []string `json:"rooms" jsonschema:"the room (position) names found"`
+}
+
+// PowerUsage is the power metering of a device.
+type PowerUsage struct {
+	ID        int      `json:"endpoint_id" jsonschema:"the device id"`
+	Name      string   `json:"device_name" jsonschema:"the device name"`
+	Watts     *float64 `json:"watts,omitempty" jsonschema:"the current power draw in watts, if reported"`
+	EnergyKWh *float64 `json:"energy_kwh,omitempty" jsonschema:"the energy consumed in kWh, if reported"`
+}
+
+// PowerOutput is the structured content of the power query tool.
+type PowerOutput struct {
+	Devices   []PowerUsage `json:"devices" jsonschema:"the devices with power metering"`
+	Unmetered []int        `json:"unmetered" jsonschema:"the ids of the devices without power metering"`
+}
+
+// DeviceOnline is the reachability of a device.
+type DeviceOnline struct {
+	ID       int    `json:"endpoint_id" jsonschema:"the device id"`
+	Name     string `json:"device_name" jsonschema:"the device name"`
+	Position string `json:"position_name" jsonschema:"the position (room) of the device"`
+	Online   *bool  `json:"online" jsonschema:"whether the device is online, null if its reachability is not reported"`
+}
+
+// OnlineOutput is the structured content of the online status tool.
+type OnlineOutput struct {
+	Devices []DeviceOnline `json:"devices" jsonschema:"the devices found"`
+}
+
+// ScenesOutput is the structured content of the control button query tool.
+type ScenesOutput struct {
+	Scenes []Scene `json:"scenes" jsonschema:"the control buttons found"`
+}
+
+// ---------- API Wrappers ----------
+
+// DeviceQueryStructured queries devices like DeviceQuery but decodes them into structs, for
+// exactly the positions and types given.
+func DeviceQueryStructured(ctx context.Context, positions []string, types []string) ([]Device, string) {
+	text, err := queryDevices(ctx, "DeviceQuery", positions, types)
+	return decodeQuery("DeviceQuery", text, err, parseDevices)
+}
+
+// DeviceStatusQueryStructured queries device status like DeviceStatusQuery but decodes them
+// into structs, for exactly the positions and types given.
+func DeviceStatusQueryStructured(ctx context.Context, positions []string, types []string) ([]Device, string) {
+	text, err := queryDevices(ctx, "DeviceStatusQuery", positions, types)
+	return decodeQuery("DeviceStatusQuery", text, err, parseDevices)
+}
+
+// GetScenesStructured queries scenes like GetScenes but decodes them into structs.
+func GetScenesStructured(ctx context.Context, positions []string) ([]Scene, string) {
+	text, err := queryScenes(ctx, positions)
+	return decodeQuery("GetScenes", text, err, parseScenes)
+}
+
+// GetPositions returns the distinct positions (rooms) of the devices in the current home, sorted.
+func GetPositions(ctx context.Context) ([]string, string) {
+	devices, message := DeviceQueryStructured(ctx, nil, nil)
+	if message != "" {
+		return nil, message
+	}
+	positions := make([]string, 0, len(devices))
+	for _, d := range devices {
+		if p := strings.TrimSpace(d.Position); p != "" {
+			positions = append(positions, p)
+		}
+	}
+	slices.Sort(positions)
+	return slices.Compact(positions), ""
+}
+
+// HomeSnapshot queries the devices and their status concurrently and merges them by device id.
+// If one of the queries fails, what the other returned is kept along with a warning, a message
+// is returned only if both fail.
+func HomeSnapshot(ctx context.Context) (devices []Device, warning string, message string) {
+	var (
+		wg                         sync.WaitGroup
+		listed, statuses           []Device
+		listMessage, statusMessage string
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		listed, listMessage = DeviceQueryStructured(ctx, nil, nil)
+	}()
+	go func() {
+		defer wg.Done()
+		statuses, statusMessage = DeviceStatusQueryStructured(ctx, nil, nil)
+	}()
+	wg.Wait()
+
+	switch {
+	case listMessage != "" && statusMessage != "":
+		return nil, "", listMessage
+	case listMessage != "":
+		return statuses, tr("Device list failed, status only: %s", listMessage), ""
+	case statusMessage != "":
+		return listed, tr("Device status failed, devices only: %s", statusMessage), ""
+	}
+
+	byID := make(map[int]Device, len(statuses))
+	for _, d := range statuses {
+		byID[d.ID] = d
+	}
+	devices = make([]Device, 0, len(listed))
+	for _, d := range listed {
+		if status, ok := byID[d.ID]; ok {
+			d.Attributes = status.Attributes
+		}
+		devices = append(devices, d)
+	}
+	return devices, "", ""
+}
+
+// FindDevicesByName returns the devices named name, compared case-insensitively and trimmed.
+// When none matches exactly, the devices with the most similar name are returned if it reaches
+// FUZZY_MATCH_THRESHOLD, otherwise suggestions of similar device names.
+func FindDevicesByName(ctx context.Context, name string) ([]Device, []string, string) {
+	devices, message := DeviceQueryStructured(ctx, nil, nil)
+	if message != "" {
+		return nil, nil, message
+	}
+	matched := devicesNamed(devices, name)
+	if len(matched) > 0 {
+		return matched, nil, ""
+	}
+	names := make([]string, len(devices))
+	for i, d := range devices {
+		names[i] = d.Name
+	}
+	best, suggestions := fuzzyMatch(name, names, FUZZY_MATCH_THRESHOLD)
+	if best == "" {
+		return nil, suggestions, ""
+	}
+	log.Info("Resolved device name", "name", name, "match", best)
+	return devicesNamed(devices, best), nil, ""
+}
+
+// devicesNamed returns the devices named name, compared case-insensitively and trimmed.
+func devicesNamed(devices []Device, name string) []Device {
+	name = strings.TrimSpace(name)
+	var matched []Device
+	for _, d := range devices {
+		if strings.EqualFold(strings.TrimSpace(d.Name), name) {
+			matched = append(matched, d)
+		}
+	}
+	return matched
+}
+
+// FindScenesByName returns the scenes named name, compared case-insensitively and trimmed,
+// restricted to the room matching room if set. When none matches exactly, the scenes with the
+// most similar name are returned if it reaches FUZZY_MATCH_THRESHOLD, otherwise suggestions
+// of similar scene names.
+func FindScenesByName(ctx context.Context, name, room string) ([]Scene, []string, string) {
+	scenes, message := GetScenesStructured(ctx, nil)
+	if message != "" {
+		return nil, nil, message
+	}
+	if room != "" {
+		positions := make([]string, len(scenes))
+		for i, scene := range scenes {
+			positions[i] = scene.Position
+		}
+		resolved, _ := ResolveRoom(room, positions)
+		if resolved == "" {
+			return nil, nil, tr("No room named %q found", room)
+		}
+		scenes = slices.DeleteFunc(scenes, func(scene Scene) bool { return scene.Position != resolved })
+	}
+	matched := scenesNamed(scenes, name)
+	if len(matched) > 0 {
+		return matched, nil, ""
+	}
+	names := make([]string, len(scenes))
+	for i, scene := range scenes {
+		names[i] = scene.Name
+	}
+	best, suggestions := fuzzyMatch(name, names, FUZZY_MATCH_THRESHOLD)
+	if best == "" {
+		return nil, suggestions, ""
+	}
+	log.Info("Resolved scene name", "name", name, "match", best)
+	return scenesNamed(scenes, best), nil, ""
+}
+
+// scenesNamed returns the scenes named name, compared case-insensitively and trimmed.
+func scenesNamed(scenes []Scene, name string) []Scene {
+	name = strings.TrimSpace(name)
+	var matched []Scene
+	for _, scene := range scenes {
+		if strings.EqualFold(strings.TrimSpace(scene.Name), name) {
+			matched = append(matched, scene)
+		}
+	}
+	return matched
+}
+
+// ResolveRoom returns the position among positions matching room exactly or most similar to it
+// above FUZZY_MATCH_THRESHOLD, otherwise suggestions of similar positions.
+func ResolveRoom(room string, positions []string) (string, []string) {
+	for _, p := range positions {
+		if strings.EqualFold(strings.TrimSpace(p), strings.TrimSpace(room)) {
+			return p, nil
+		}
+	}
+	best, suggestions := fuzzyMatch(room, positions, FUZZY_MATCH_THRESHOLD)
+	if best != "" {
+		log.Info("Resolved room name", "room", room, "match", best)
+	}
+	return best, suggestions
+}
+
+// DeviceStatus returns the current status of device, queried by its position and type.
+func DeviceStatus(ctx context.Context, device Device) (*Device, string) {
+	devices, message := DeviceStatusQueryStructured(ctx, []string{device.Position}, []string{device.Type})
+	if message != "" {
+		return nil, message
+	}
+	for _, d := range devices {
+		if d.ID == device.ID {
+			return &d, ""
+		}
+	}
+	return nil, tr("No device status data available")
+}
+
+// ToggleDevices flips the on/off state of devices: their current state is queried and each
+// is turned to the opposite one. Devices without a simple on/off state are left untouched
+// and reported in the result.
+func ToggleDevices(ctx context.Context, devices []int) (string, bool) {
+	if len(devices) == 0 {
+		return tr("Device list cannot be empty"), false
+	}
+	statuses, message := DeviceStatusQueryStructured(ctx, nil, nil)
+	if message != "" {
+		return message, false
+	}
+	byID := make(map[int]Device, len(statuses))
+	for _, d := range statuses {
+		byID[d.ID] = d
+	}
+
+	var lines []string
+	var turnOn, turnOff []Device
+	for _, id := range devices {
+		d, ok := byID[id]
+		if !ok {
+			lines = append(lines, tr("Device %d not found", id))
+			continue
+		}
+		on, ok := parseOnOff(d.Attributes[SlotOnOff])
+		if !ok {
+			lines = append(lines, tr("%s has no on/off state to toggle", d.Name))
+			continue
+		}
+		if on {
+			turnOff = append(turnOff, d)
+		} else {
+			turnOn = append(turnOn, d)
+		}
+	}
+
+	toggled := false
+	for _, group := range []struct {
+		on      bool
+		devices []Device
+	}{{true, turnOn}, {false, turnOff}} {
+		if len(group.devices) == 0 {
+			continue
+		}
+		ids := make([]int, len(group.devices))
+		names := make([]string, len(group.devices))
+		for i, d := range group.devices {
+			ids[i], names[i] = d.ID, d.Name
+		}
+		result := DeviceControl(ctx, ids, OnOffSlot(group.on), "")
+		if result != tr("Device control success") {
+			lines = append(lines, result)
+			continue
+		}
+		toggled = true
+		if group.on {
+			lines = append(lines, tr("Turned on: %s", strings.Join(names, ", ")))
+		} else {
+			lines = append(lines, tr("Turned off: %s", strings.Join(names, ", ")))
+		}
+	}
+	return strings.Join(lines, "\n"), toggled
+}
+
+// AdjustBrightness changes the brightness of devices by delta percent relative to their
+// current brightness, clamped to 0-100. Devices without a brightness are left untouched
+// and reported in the result.
+func AdjustBrightness(ctx context.Context, devices []int, delta int) (string, bool) {
+	if len(devices) == 0 {
+		return tr("Device list cannot be empty"), false
+	}
+	statuses, message := DeviceStatusQueryStructured(ctx, nil, nil)
+	if message != "" {
+		return message, false
+	}
+	byID := make(map[int]Device, len(statuses))
+	for _, d := range statuses {
+		byID[d.ID] = d
+	}
+
+	var lines []string
+	adjusted := false
+	for _, id := range devices {
+		d, ok := byID[id]
+		if !ok {
+			lines = append(lines, tr("Device %d not found", id))
+			continue
+		}
+		current, ok := parseNumber(d.Attributes[SlotBrightness])
+		if !ok {
+			lines = append(lines, tr("%s has no brightness to adjust", d.Name))
+			continue
+		}
+		target := min(100, max(0, int(current)+delta))
+		slot, _ := BrightnessSlot(target)
+		result := DeviceControl(ctx, []int{id}, slot, "")
+		if result != tr("Device control success") {
+			lines = append(lines, result)
+			continue
+		}
+		adjusted = true
+		lines = append(lines, tr("%s brightness %d%% -> %d%%", d.Name, int(current), target))
+	}
+	return strings.Join(lines, "\n"), adjusted
+}
+
+// parseBrightnessDelta parses a relative brightness change like "+10%" or "-20".
+func parseBrightnessDelta(change string) (int, error) {
+	value := strings.TrimSuffix(strings.ReplaceAll(change, " ", ""), "%")
+	if !strings.HasPrefix(value, "+") && !strings.HasPrefix(value, "-") {
+		return 0, errors.New(tr("brightness change %q needs a + or - sign", change))
+	}
+	delta, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.New(tr("invalid brightness change %q, e.g. +10%%", change))
+	}
+	if delta < -100 || delta > 100 {
+		return 0, errors.New(tr("brightness change %q exceeds 100%%", change))
+	}
+	return delta, nil
+}
+
+// parseNumber reads a numeric attribute value, reported as a number or a numeric string.
+func parseNumber(value any) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// parseOnOff reads an on/off attribute value, reported as "on"/"off", a bool or 1/0.
+func parseOnOff(value any) (on bool, ok bool) {
+	switch v := value.(type) {
+	case bool:
+		return v, true
+	case float64:
+		return v != 0, true
+	case string:
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "on", "true", "1":
+			return true, true
+		case "off", "false", "0":
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// OnlineAttributes are the attributes reporting whether a device is reachable, append to
+// them to support devices naming it differently.
+var OnlineAttributes = []string{"online", "online_status", "is_online", "reachable"}
+
+// OnlineStatus reports whether the devices in positions, or only those with the given ids
+// if any, are online. Devices not reporting their reachability are unknown, not offline.
+func OnlineStatus(ctx context.Context, positions []string, devices []int) (*OnlineOutput, string, string) {
+	statuses, message := DeviceStatusQueryStructured(ctx, positions, nil)
+	if message != "" {
+		return nil, "", message
+	}
+	output := &OnlineOutput{Devices: []DeviceOnline{}}
+	var lines []string
+	for _, d := range statuses {
+		if len(devices) > 0 && !slices.Contains(devices, d.ID) {
+			continue
+		}
+		status := DeviceOnline{ID: d.ID, Name: d.Name, Position: d.Position}
+		line := tr("%s (%s): unknown", d.Name, d.Position)
+		for _, name := range OnlineAttributes {
+			if online, ok := parseOnline(d.Attributes[name]); ok {
+				status.Online = &online
+				line = tr("%s (%s): offline", d.Name, d.Position)
+				if online {
+					line = tr("%s (%s): online", d.Name, d.Position)
+				}
+				break
+			}
+		}
+		output.Devices = append(output.Devices, status)
+		lines = append(lines, line)
+	}
+	for _, id := range devices {
+		if !slices.ContainsFunc(output.Devices, func(s DeviceOnline) bool { return s.ID == id }) {
+			lines = append(lines, tr("Device %d not found", id))
+		}
+	}
+	if len(lines) == 0 {
+		return output, tr("No device status data available"), ""
+	}
+	return output, strings.Join(lines, "\n"), ""
+}
+
+// parseOnline reads a reachability attribute value, reported like an on/off value or as
+// "online"/"offline".
+func parseOnline(value any) (online bool, ok bool) {
+	if v, isString := value.(string); isString {
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "online", "reachable":
+			return true, true
+		case "offline", "unreachable":
+			return false, true
+		}
+	}
+	return parseOnOff(value)
+}
+
+// Attributes reporting the power draw in watts and the consumed energy in kWh, append to
+// them to support devices naming their metering differently.
+var (
+	PowerAttributes  = []string{"power", "load_power", "active_power"}
+	EnergyAttributes = []string{"energy", "consumption", "power_consumption", "electricity"}
+)
+
+// QueryPower reads the power metering of devices from their current status. If a time span
+// is given, the metering logs of the metered devices within it are returned as well, as
+// queried by DeviceLogQuery. Devices without metering are listed in the output.
+func QueryPower(ctx context.Context, devices []int, startDatetime, endDatetime string) (*PowerOutput, string, string) {
+	if len(devices) == 0 {
+		return nil, "", tr("Device list cannot be empty")
+	}
+	statuses, message := DeviceStatusQueryStructured(ctx, nil, nil)
+	if message != "" {
+		return nil, "", message
+	}
+	byID := make(map[int]Device, len(statuses))
+	for _, d := range statuses {
+		byID[d.ID] = d
+	}
+
+	output := &PowerOutput{Devices: []PowerUsage{}, Unmetered: []int{}}
+	var lines []string
+	for _, id := range devices {
+		d, ok := byID[id]
+		if !ok {
+			lines = append(lines, tr("Device %d not found", id))
+			continue
+		}
+		usage := PowerUsage{ID: d.ID, Name: d.Name}
+		usage.Watts = meteredValue(d.Attributes, PowerAttributes)
+		usage.EnergyKWh = meteredValue(d.Attributes, EnergyAttributes)
+		if usage.Watts == nil && usage.EnergyKWh == nil {
+			output.Unmetered = append(output.Unmetered, d.ID)
+			lines = append(lines, tr("%s has no power metering", d.Name))
+			continue
+		}
+		output.Devices = append(output.Devices, usage)
+		lines = append(lines, describePower(usage))
+	}
+
+	if len(output.Devices) > 0 && (strings.TrimSpace(startDatetime) != "" || strings.TrimSpace(endDatetime) != "") {
+		metered := make([]int, len(output.Devices))
+		for i, usage := range output.Devices {
+			metered[i] = usage.ID
+		}
+		attributes := slices.Concat(PowerAttributes, EnergyAttributes)
+		lines = append(lines, "", DeviceLogQuery(ctx, metered, startDatetime, endDatetime, attributes, 0, 0))
+	}
+	return output, strings.Join(lines, "\n"), ""
+}
+
+// meteredValue returns the first of the attributes reported with a numeric value.
+func meteredValue(attributes map[string]any, names []string) *float64 {
+	for _, name := range names {
+		if v, ok := parseNumber(attributes[name]); ok {
+			return &v
+		}
+	}
+	return nil
+}
+
+// describePower summarizes the power metering of a device, e.g. "Desk plug: 35 W, 1.2 kWh".
+func describePower(usage PowerUsage) string {
+	var values []string
+	if usage.Watts != nil {
+		values = append(values, strconv.FormatFloat(*usage.Watts, 'f', -1, 64)+" W")
+	}
+	if usage.EnergyKWh != nil {
+		values = append(values, strconv.FormatFloat(*usage.EnergyKWh, 'f', -1, 64)+" kWh")
+	}
+	return usage.Name + ": " + strings.Join(values, ", ")
+}
+
+// ValidateSlots checks the keys of slots against the attributes the devices report in the
+// device list, returning a message listing the valid keys of the first device that does not
+// support one of them, or empty if all are supported. Devices reporting no attributes, or
+// missing from the list, are not checked.
+func ValidateSlots(ctx context.Context, devices []int, slots map[string]any) string {
+	listed, message := DeviceQueryStructured(ctx, nil, nil)
+	if message != "" {
+		return message
+	}
+	for _, d := range listed {
+		if !slices.Contains(devices, d.ID) || len(d.Attributes) == 0 {
+			continue
+		}
+		var unknown []string
+		for key := range slots {
+			if _, ok := d.Attributes[key]; !ok {
+				unknown = append(unknown, key)
+			}
+		}
+		if len(unknown) > 0 {
+			slices.Sort(unknown)
+			valid := slices.Sorted(maps.Keys(d.Attributes))
+			return tr("%s does not support %s, valid keys: %s", d.Name, strings.Join(unknown, ", "), strings.Join(valid, ", "))
+		}
+	}
+	return ""
+}
+
+// VerifyDeviceState re-queries the status of devices after slots were applied to them and
+// describes their new state, e.g. "Living room light is now ON at 80%".
+//
+// The backend may report the new state with a delay, so while a reported attribute still
+// differs from slots the query is retried up to CONTROL_VERIFY_RETRIES times, waiting
+// CONTROL_VERIFY_DELAY in between. The last state is returned with a note if it never matched.
+func VerifyDeviceState(ctx context.Context, devices []int, slots map[string]any) string {
+	var controlled []Device
+	for attempt := 0; ; attempt++ {
+		statuses, message := DeviceStatusQueryStructured(ctx, nil, nil)
+		if message != "" {
+			return tr("Could not verify the device state: %s", message)
+		}
+		controlled = slices.DeleteFunc(statuses, func(d Device) bool { return !slices.Contains(devices, d.ID) })
+		if slotsApplied(controlled, devices, slots) || attempt >= int(CONTROL_VERIFY_RETRIES) {
+			break
+		}
+		log.Debug("Device state not updated yet, querying again", "devices", devices, "attempt", attempt+1)
+		select {
+		case <-ctx.Done():
+			return tr("Could not verify the device state: %s", ctx.Err())
+		case <-time.After(CONTROL_VERIFY_DELAY):
+		}
+	}
+
+	lines := make([]string, 0, len(controlled)+1)
+	for _, d := range controlled {
+		lines = append(lines, describeState(d, slots))
+	}
+	if !slotsApplied(controlled, devices, slots) {
+		lines = append(lines, tr("The new state may not have propagated yet"))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// slotsApplied reports whether all devices are found in controlled and report the values of
+// slots. Attributes a device does not report are not checked.
+func slotsApplied(controlled []Device, devices []int, slots map[string]any) bool {
+	if len(controlled) < len(devices) {
+		return false
+	}
+	for _, d := range controlled {
+		for key, want := range slots {
+			// Compare the printed values, as numbers are decoded as float64.
+			if got, ok := d.Attributes[key]; ok && fmt.Sprint(got) != fmt.Sprint(want) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// describeState describes the state of device for the attributes set by slots.
+func describeState(device Device, slots map[string]any) string {
+	var parts []string
+	if v, ok := device.Attributes[SlotOnOff]; ok {
+		parts = append(parts, strings.ToUpper(fmt.Sprint(v)))
+	}
+	if v, ok := device.Attributes[SlotBrightness]; ok {
+		parts = append(parts, fmt.Sprintf("at %v%%", v))
+	}
+	if v, ok := device.Attributes[SlotColorTemp]; ok {
+		parts = append(parts, fmt.Sprintf("%vK", v))
+	}
+	others := make(map[string]any)
+	for key := range slots {
+		if v, ok := device.Attributes[key]; ok && key != SlotOnOff && key != SlotBrightness && key != SlotColorTemp {
+			others[key] = v
+		}
+	}
+	if len(others) > 0 {
+		parts = append(parts, formatAttributes(others))
+	}
+	if len(parts) == 0 {
+		parts = append(parts, formatAttributes(device.Attributes))
+	}
+	return tr("%s is now %s", device.Name, strings.Join(parts, " "))
+}
+
+// decodeQuery decodes the result text of a query service with parse, returning the error of
+// the call or of decoding as a message.
+func decodeQuery[T any](serviceName, text string, err error, parse func(string) (T, error)) (T, string) {
+	var value T
+	if err != nil {
+		return value, err.Error()
+	}
+	value, err = parse(text)
+	if err != nil {
+		return value, tr("Failed to decode %s result: %v", serviceName, err)
+	}
+	return value, ""
+}
+
+// queryFilter returns the positions or device types to query for a caller's values: empty
+// values fall back to defaults, the configured DEFAULT_POSITIONS or DEFAULT_DEVICE_TYPES,
+// and ["*"] asks for all of them regardless of the defaults. An empty result means all.
+func queryFilter(values, defaults []string) []string {
+	if len(values) == 0 {
+		return defaults
+	}
+	if len(values) == 1 && strings.TrimSpace(values[0]) == "*" {
+		return nil
+	}
+	return values
+}
+
+// orEmpty returns an empty slice for nil, so it is encoded as [] rather than null.
+func orEmpty[T any](list []T) []T {
+	if list == nil {
+		return []T{}
+	}
+	return list
+}
+
+// ---------- Markdown ----------
+
+// DevicesMarkdown renders devices as a Markdown table, like the backend's Markdown output.
+func DevicesMarkdown(devices []Device) string {
+	if len(devices) == 0 {
+		return tr("No device data available")
+	}
+	var b strings.Builder
+	b.WriteString("| ID | Name | Position | Type | Attributes |\n")
+	b.WriteString("| --- | --- | --- | --- | --- |\n")
+	for _, d := range devices {
+		fmt.Fprintf(&b, "| %d | %s | %s | %s | %s |\n", d.ID, d.Name, d.Position, d.Type, formatAttributes(d.Attributes))
+	}
+	return b.String()
+}
+
+// ScenesMarkdown renders scenes as a Markdown table.
+func ScenesMarkdown(scenes []Scene) string {
+	if len(scenes) == 0 {
+		return tr("No scenes available")
+	}
+	var b strings.Builder
+	b.WriteString("| ID | Name | Position |\n")
+	b.WriteString("| --- | --- | --- |\n")
+	for _, s := range scenes {
+		fmt.Fprintf(&b, "| %d | %s | %s |\n", s.ID, s.Name, s.Position)
+	}
+	return b.String()
+}
+
+// formatAttributes renders attributes as "key=value" pairs sorted by key.
+func formatAttributes(attributes map[string]any) string {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = fmt.Sprintf("%s=%v", k, attributes[k])
+	}
+	return strings.Join(pairs, ", ")
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/devfans/golang/log"
+)
+
+// logTimeLayout is the time format of the DeviceLogQuery time span.
+const logTimeLayout = "2006-01-02 15:04:05"
+
+// logTimeLayouts are the accepted formats of log query times. Times without an offset are
+// taken as times of the home time zone.
+var logTimeLayouts = []string{
+	logTimeLayout,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	time.RFC3339,
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05 Z07:00",
+}
+
+// homeLocation is the time zone the backend reads schedules and log times in.
+var homeLocation = loadHomeLocation(HOME_TIME_ZONE)
+
+// loadHomeLocation loads the home time zone, falling back to UTC if it is unknown.
+func loadHomeLocation(name string) *time.Location {
+	loc, err := parseZone(name)
+	if err != nil {
+		log.Warn("Unknown home time zone, using UTC", "time_zone", name, "err", err)
+		return time.UTC
+	}
+	return loc
+}
+
+// parseZone parses an IANA time zone name like "Asia/Shanghai", or a fixed UTC offset like
+// "+08:00", "-0500", "+8" or "UTC+8".
+func parseZone(name string) (*time.Location, error) {
+	name = strings.TrimSpace(name)
+	offset := strings.TrimPrefix(strings.TrimPrefix(name, "UTC"), "GMT")
+	if offset == "" || offset == "Z" {
+		return time.UTC, nil
+	}
+	if offset[0] != '+' && offset[0] != '-' {
+		return time.LoadLocation(name)
+	}
+	hours, minutes, hasMinutes := strings.Cut(offset[1:], ":")
+	if !hasMinutes && len(hours) == 4 {
+		hours, minutes = hours[:2], hours[2:]
+	}
+	h, err := strconv.Atoi(hours)
+	m := 0
+	if err == nil && minutes != "" {
+		m, err = strconv.Atoi(minutes)
+	}
+	if err != nil || h > 14 || m > 59 {
+		return nil, fmt.Errorf("invalid UTC offset %q", name)
+	}
+	seconds := h*3600 + m*60
+	if offset[0] == '-' {
+		seconds = -seconds
+	}
+	return time.FixedZone(name, seconds), nil
+}
+
+// normalizeLogTime converts a log query time, optionally carrying a UTC offset, into the
+// "YYYY-MM-DD HH:MM:SS" format of the home time zone. Empty values are kept empty.
+//
+// A time without an offset that falls in a DST gap of the home time zone, like 02:30 on a
+// spring-forward day, does not exist and is shifted by the length of the gap, and one
+// repeated on a fall-back day is taken as one of its two occurrences.
+func normalizeLogTime(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", nil
+	}
+	for _, layout := range logTimeLayouts {
+		if t, err := time.ParseInLocation(layout, value, homeLocation); err == nil {
+			return t.In(homeLocation).Format(logTimeLayout), nil
+		}
+	}
+	return "", fmt.Errorf("expected 'YYYY-MM-DD HH:MM:SS', optionally followed by an offset like +08:00")
+}
+
+// convertSchedule converts the crontab expression scheduledTime, given in the time zone from,
+// into the home time zone. The minute and hour must be single values.
+//
+// A schedule on a single day of a single month is converted at its next occurrence after now,
+// so the DST rules of both zones on that day apply. Other schedules are converted with the
+// offsets in effect now: when either zone changes DST later, the task keeps firing at the
+// converted home time and so drifts by an hour in from. A schedule moved across midnight
+// shifts its weekdays along, which is not possible when it also pins a day or month, as the
+// fields would no longer move together. A time falling in a DST gap of from is rejected, as
+// it never occurs there.
+func convertSchedule(scheduledTime string, from *time.Location, now time.Time) (string, error) {
+	fields := strings.Fields(scheduledTime)
+	if len(fields) != len(cronFields) {
+		return "", fmt.Errorf("expected 5 fields 'minute hour day month weekday', got %d", len(fields))
+	}
+	minute, hour, day, month, weekday := fields[0], fields[1], fields[2], fields[3], fields[4]
+	if !isSingleValue(minute) || !isSingleValue(hour) {
+		return "", fmt.Errorf("converting a schedule between time zones needs a single minute and hour, got '%s %s'", minute, hour)
+	}
+	m, _ := strconv.Atoi(minute)
+	h, _ := strconv.Atoi(hour)
+
+	if isSingleValue(day) && isSingleValue(month) {
+		d, _ := strconv.Atoi(day)
+		mo, _ := strconv.Atoi(month)
+		year := now.In(from).Year()
+		t := time.Date(year, time.Month(mo), d, h, m, 0, 0, from)
+		if t.Before(now) {
+			t = time.Date(year+1, time.Month(mo), d, h, m, 0, 0, from)
+		}
+		if t.Hour() != h || t.Minute() != m {
+			return "", fmt.Errorf("%02d:%02d does not exist on %s in %s, the clocks skip it for DST", h, m, t.Format("2006-01-02"), from)
+		}
+		local := t.In(homeLocation)
+		if weekday != "*" && local.Day() != t.Day() {
+			return "", fmt.Errorf("the schedule moves to another day in the home time zone, which is not possible along with weekday %s, give the time in the home time zone instead", weekday)
+		}
+		return fmt.Sprintf("%d %d %d %d %s", local.Minute(), local.Hour(), local.Day(), int(local.Month()), weekday), nil
+	}
+
+	ref := now.In(from)
+	t := time.Date(ref.Year(), ref.Month(), ref.Day(), h, m, 0, 0, from)
+	if t.Hour() != h || t.Minute() != m {
+		// Skipped today for DST, convert with the offset of tomorrow.
+		t = time.Date(ref.Year(), ref.Month(), ref.Day()+1, h, m, 0, 0, from)
+	}
+	local := t.In(homeLocation)
+	refDate := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	localDate := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.UTC)
+	shift := int(localDate.Sub(refDate).Hours() / 24)
+	if shift != 0 {
+		if day != "*" || month != "*" {
+			return "", fmt.Errorf("the schedule moves to another day in the home time zone, which is not possible for day %s of month %s, give the time in the home time zone instead", day, month)
+		}
+		shifted, err := shiftWeekdays(weekday, shift)
+		if err != nil {
+			return "", err
+		}
+		weekday = shifted
+	}
+	return fmt.Sprintf("%d %d %s %s %s", local.Minute(), local.Hour(), day, month, weekday), nil
+}
+
+// shiftWeekdays moves the values and ranges of a crontab weekday field by shift days,
+// splitting ranges that wrap around the week.
+func shiftWeekdays(field string, shift int) (string, error) {
+	if field == "*" {
+		return field, nil
+	}
+	move := func(value string) (int, error) {
+		n, err := parseCronValue(value, cronFields[4])
+		if err != nil {
+			return 0, err
+		}
+		return ((n+shift)%7 + 7) % 7, nil
+	}
+	var items []string
+	for _, item := range strings.Split(field, ",") {
+		if strings.Contains(item, "/") || strings.Contains(item, "*") {
+			return "", fmt.Errorf("cannot shift weekday %q to another day, give the time in the home time zone instead", item)
+		}
+		from, to, isRange := strings.Cut(item, "-")
+		start, err := move(from)
+		if err != nil {
+			return "", err
+		}
+		if !isRange {
+			items = append(items, strconv.Itoa(start))
+			continue
+		}
+		end, err := move(to)
+		if err != nil {
+			return "", err
+		}
+		if start <= end {
+			items = append(items, fmt.Sprintf("%d-%d", start, end))
+		} else {
+			items = append(items, fmt.Sprintf("%d-6", start), fmt.Sprintf("0-%d", end))
+		}
+	}
+	return strings.Join(items, ","), nil
+}
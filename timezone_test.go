@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConvertSchedule(t *testing.T) {
+	shanghai, _ := time.LoadLocation("Asia/Shanghai")
+	newYork, _ := time.LoadLocation("America/New_York")
+	setForTest(t, &homeLocation, shanghai)
+	winter := time.Date(2026, 1, 5, 12, 0, 0, 0, newYork)
+	springForward := time.Date(2026, 3, 8, 0, 0, 0, 0, newYork)
+
+	for _, tc := range []struct {
+		name     string
+		schedule string
+		now      time.Time
+		want     string
+	}{
+		{"same day", "0 8 * * *", winter, "0 21 * * *"},
+		{"weekdays shifted", "0 20 * * 1-5", winter, "0 9 * * 2-6"},
+		{"weekday range wrapped", "30 22 * * 5-6", winter, "30 11 * * 6-6,0-0"},
+		{"weekday list shifted", "0 20 * * 0,3", winter, "0 9 * * 1,4"},
+		{"single date moved", "0 20 25 12 *", winter, "0 9 26 12 *"},
+		{"single date at month end", "0 20 31 1 *", winter, "0 9 1 2 *"},
+		{"single date keeps weekday", "0 8 25 12 5", winter, "0 21 25 12 5"},
+		{"single date after DST", "0 8 1 7 *", winter, "0 20 1 7 *"},
+		// 02:30 is skipped on spring-forward day, the daily task converts with the new offset.
+		{"periodic in DST gap", "30 2 * * *", springForward, "30 14 * * *"},
+		{"day pinned without shift", "0 8 1 * *", winter, "0 21 1 * *"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := convertSchedule(tc.schedule, newYork, tc.now)
+			if err != nil || got != tc.want {
+				t.Errorf("convertSchedule(%q) = %q %v, want %q", tc.schedule, got, err, tc.want)
+			}
+		})
+	}
+
+	for _, tc := range []struct {
+		name     string
+		schedule string
+		now      time.Time
+	}{
+		{"one-time in DST gap", "30 2 8 3 *", springForward.AddDate(0, 0, -7)},
+		{"day pinned with shift", "0 20 1 * *", winter},
+		{"month pinned with shift", "0 20 * 1 1", winter},
+		{"single date pinning weekday moved", "0 20 25 12 5", winter},
+		{"range of hours", "0 8-10 * * *", winter},
+		{"weekday step shifted", "0 20 * * */2", winter},
+		{"missing field", "0 8 * *", winter},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got, err := convertSchedule(tc.schedule, newYork, tc.now); err == nil {
+				t.Errorf("convertSchedule(%q) = %q, want an error", tc.schedule, got)
+			}
+		})
+	}
+}
+
+func TestNormalizeLogTime(t *testing.T) {
+	newYork, _ := time.LoadLocation("America/New_York")
+	setForTest(t, &homeLocation, newYork)
+	for _, tc := range []struct {
+		value string
+		want  string
+	}{
+		{"", ""},
+		{"2026-01-05 10:00:00", "2026-01-05 10:00:00"},
+		{"2026-01-05T10:00:00", "2026-01-05 10:00:00"},
+		{"2026-01-05", "2026-01-05 00:00:00"},
+		{"2026-01-01T10:00:00+08:00", "2025-12-31 21:00:00"},
+		{"2026-07-01 10:00:00 +08:00", "2026-06-30 22:00:00"},
+	} {
+		got, err := normalizeLogTime(tc.value)
+		if err != nil || got != tc.want {
+			t.Errorf("normalizeLogTime(%q) = %q %v, want %q", tc.value, got, err, tc.want)
+		}
+	}
+	// 02:30 does not exist on spring-forward day and is shifted by the hour of the gap.
+	if got, err := normalizeLogTime("2026-03-08 02:30:00"); err != nil || (got != "2026-03-08 01:30:00" && got != "2026-03-08 03:30:00") {
+		t.Errorf("normalizeLogTime in DST gap = %q %v, want it shifted out of the gap", got, err)
+	}
+	if _, err := normalizeLogTime("yesterday"); err == nil {
+		t.Error("accepted an invalid time")
+	}
+}
+
+func TestParseZone(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		offset int
+	}{
+		{"UTC", 0},
+		{"+08:00", 8 * 3600},
+		{"-0530", -(5*3600 + 30*60)},
+		{"UTC+8", 8 * 3600},
+		{"GMT-3", -3 * 3600},
+	} {
+		loc, err := parseZone(tc.name)
+		if err != nil {
+			t.Errorf("parseZone(%q): %v", tc.name, err)
+			continue
+		}
+		if _, offset := time.Date(2026, 1, 1, 0, 0, 0, 0, loc).Zone(); offset != tc.offset {
+			t.Errorf("parseZone(%q) has offset %d, want %d", tc.name, offset, tc.offset)
+		}
+	}
+	for _, name := range []string{"+15", "+08:60", "Mars/Olympus"} {
+		if _, err := parseZone(name); err == nil {
+			t.Errorf("parseZone(%q) accepted an invalid zone", name)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/devfans/golang/log"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of this server. It is a no-op until setupTracing installs an exporter.
+var tracer = otel.Tracer("yalla-mcp")
+
+// setupTracing exports traces to OTEL_EXPORTER_OTLP_ENDPOINT over OTLP/HTTP and returns a
+// function flushing pending spans. Tracing stays a no-op when the endpoint is unset.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	if OTEL_EXPORTER_OTLP_ENDPOINT == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(OTEL_EXPORTER_OTLP_ENDPOINT))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceName("yalla-mcp"),
+			semconv.ServiceVersion(Version),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	log.Info("Tracing enabled", "endpoint", OTEL_EXPORTER_OTLP_ENDPOINT)
+	return provider.Shutdown, nil
+}
+
+// tracingMiddleware wraps each tool call in a span, upstream calls made by the tool become its children.
+func tracingMiddleware(next mcp.MethodHandler) mcp.MethodHandler {
+	return func(ctx context.Context, method string, req mcp.Request) (mcp.Result, error) {
+		ctr, ok := req.(*mcp.CallToolRequest)
+		if !ok {
+			return next(ctx, method, req)
+		}
+		ctx, span := tracer.Start(ctx, "tools/call "+ctr.Params.Name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("mcp.tool.name", ctr.Params.Name)),
+		)
+		defer span.End()
+
+		result, err := next(ctx, method, req)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		} else if r, ok := result.(*mcp.CallToolResult); ok && r != nil && r.IsError {
+			span.SetStatus(codes.Error, "tool returned an error result")
+		}
+		return result, err
+	}
+}
+
+// startUpstreamSpan starts a client span for an upstream call to the cloud service.
+func startUpstreamSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// endUpstreamSpan records the outcome of an upstream call and ends its span.
+func endUpstreamSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// shutdownTracing flushes pending spans, giving up after a few seconds.
+func shutdownTracing(shutdown func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdown(ctx); err != nil {
+		log.Error("Failed to flush traces", "err", err)
+	}
+}
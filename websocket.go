@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/devfans/golang/log"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/modelcontextprotocol/go-sdk/jsonrpc"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// wsUpgrader upgrades MCP requests to WebSocket connections, offering the "mcp" subprotocol.
+// Origins are checked against ALLOWED_ORIGINS like CORS requests, all are allowed if unset.
+var wsUpgrader = websocket.Upgrader{
+	Subprotocols: []string{"mcp"},
+	CheckOrigin: func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		return len(allowedOrigins) == 0 || origin == "" || slices.Contains(allowedOrigins, origin)
+	},
+}
+
+// newWebSocketHandler serves a session of server over each WebSocket connection, a JSON-RPC
+// message per text frame. The handshake is a plain HTTP request, so it goes through the same
+// auth middleware as SSE.
+func newWebSocketHandler(server *mcp.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// Upgrade has already replied with the error.
+			log.Debug("WebSocket upgrade failed", "remote", r.RemoteAddr, "err", err)
+			return
+		}
+		ss, err := server.Connect(r.Context(), &wsTransport{conn: conn}, nil)
+		if err != nil {
+			log.Error("Failed to start WebSocket session", "remote", r.RemoteAddr, "err", err)
+			conn.Close()
+			return
+		}
+		log.Debug("WebSocket session started", "remote", r.RemoteAddr, "session", ss.ID())
+		// The connection is hijacked, but its request context ends when the handler returns.
+		ss.Wait()
+		log.Debug("WebSocket session closed", "remote", r.RemoteAddr, "session", ss.ID())
+	})
+}
+
+// wsTransport is an mcp.Transport over an upgraded WebSocket connection.
+type wsTransport struct {
+	conn *websocket.Conn
+}
+
+func (t *wsTransport) Connect(ctx context.Context) (mcp.Connection, error) {
+	return &wsConnection{conn: t.conn, id: uuid.NewString()}, nil
+}
+
+// wsConnection reads and writes JSON-RPC messages as WebSocket text frames.
+type wsConnection struct {
+	conn      *websocket.Conn
+	id        string
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func (c *wsConnection) Read(ctx context.Context) (jsonrpc.Message, error) {
+	for {
+		kind, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if kind != websocket.TextMessage && kind != websocket.BinaryMessage {
+			continue
+		}
+		msg, err := jsonrpc.DecodeMessage(data)
+		if err == nil {
+			return msg, nil
+		}
+		// A bad frame is the client's mistake, answer it and keep the session open.
+		code, message := -32600, "Invalid Request"
+		if !json.Valid(data) {
+			code, message = -32700, "Parse error"
+		}
+		log.Debug("Invalid WebSocket message", "session", c.id, "err", err)
+		if err := c.writeError(code, message+": "+err.Error()); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// writeError sends a JSON-RPC error response without an id, for a message that could not be
+// decoded. jsonrpc.Response cannot carry an error code, so the frame is encoded here.
+func (c *wsConnection) writeError(code int, message string) error {
+	data, err := json.Marshal(map[string]any{
+		"jsonrpc": "2.0",
+		"id":      nil,
+		"error":   map[string]any{"code": code, "message": message},
+	})
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// Write sends msg, serializing concurrent writers as the connection allows only one.
+func (c *wsConnection) Write(ctx context.Context, msg jsonrpc.Message) error {
+	data, err := jsonrpc.EncodeMessage(msg)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// Close closes the connection, unblocking a pending Read.
+func (c *wsConnection) Close() error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.conn.Close()
+	})
+	return c.closeErr
+}
+
+func (c *wsConnection) SessionID() string {
+	return c.id
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+func TestWebSocketInvalidMessages(t *testing.T) {
+	server := mcp.NewServer(&mcp.Implementation{Name: "test"}, nil)
+	httpServer := httptest.NewServer(newWebSocketHandler(server))
+	defer httpServer.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	roundTrip := func(frame string) map[string]any {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("no reply to %s: %v", frame, err)
+		}
+		var reply map[string]any
+		if err := json.Unmarshal(data, &reply); err != nil {
+			t.Fatalf("invalid reply %s: %v", data, err)
+		}
+		return reply
+	}
+	errorCode := func(reply map[string]any) float64 {
+		e, _ := reply["error"].(map[string]any)
+		code, _ := e["code"].(float64)
+		return code
+	}
+
+	if reply := roundTrip(`{"jsonrpc":"2.0","id":1,`); errorCode(reply) != -32700 || reply["id"] != nil {
+		t.Errorf("got %v for malformed JSON, want a parse error", reply)
+	}
+	if reply := roundTrip(`{"jsonrpc":"1.0","id":1,"method":"ping"}`); errorCode(reply) != -32600 {
+		t.Errorf("got %v for an invalid message, want an invalid request error", reply)
+	}
+	if reply := roundTrip(`{"jsonrpc":"2.0","id":2,"method":"ping"}`); reply["id"] != float64(2) || reply["error"] != nil {
+		t.Errorf("got %v for a ping after invalid messages, want the session kept", reply)
+	}
+}